@@ -0,0 +1,180 @@
+package falclient
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+)
+
+var (
+	ErrUnauthorized    = errors.New("unauthorized")
+	ErrPaymentRequired = errors.New("payment required")
+	ErrNotFound        = errors.New("not found")
+	ErrValidation      = errors.New("validation error")
+	ErrRateLimited     = errors.New("rate limited")
+)
+
+// RequestIDHeader response header carrying the fal request id
+const RequestIDHeader = "X-Fal-Request-Id"
+
+// ValidationError a single item of the fal validation detail list
+type ValidationError struct {
+	Loc  []any  `json:"loc,omitempty"`
+	Msg  string `json:"msg,omitempty"`
+	Type string `json:"type,omitempty"`
+}
+
+func (e ValidationError) Error() string {
+	if len(e.Loc) == 0 {
+		return e.Msg
+	}
+	locs := make([]string, 0, len(e.Loc))
+	for _, v := range e.Loc {
+		locs = append(locs, fmt.Sprint(v))
+	}
+	return fmt.Sprintf("%s: %s", strings.Join(locs, "."), e.Msg)
+}
+
+// APIError non-2xx response returned by fal apis
+type APIError struct {
+	// StatusCode http status code
+	StatusCode int `json:"status_code,omitempty"`
+	// Type error type
+	Type string `json:"type,omitempty"`
+	// Message error message
+	Message string `json:"message,omitempty"`
+	// Detail validation detail list
+	Detail []ValidationError `json:"detail,omitempty"`
+	// RequestID fal request id
+	RequestID string `json:"request_id,omitempty"`
+	// Header response headers
+	Header http.Header `json:"-"`
+	// Body raw response body
+	Body []byte `json:"-"`
+}
+
+// NewAPIError reads the response body and builds an APIError, the body is not closed
+func NewAPIError(resp *http.Response) *APIError {
+	body, _ := io.ReadAll(resp.Body)
+	ret := &APIError{
+		StatusCode: resp.StatusCode,
+		Header:     resp.Header,
+		Body:       body,
+		RequestID:  resp.Header.Get(RequestIDHeader),
+		Type:       resp.Header.Get("X-Fal-Error-Type"),
+	}
+	ret.parse(body)
+	if ret.Message == "" {
+		if len(ret.Detail) > 0 {
+			ret.Message = ret.Detail[0].Msg
+		} else if msg := string(bytes.TrimSpace(body)); msg != "" {
+			ret.Message = msg
+		} else {
+			ret.Message = http.StatusText(resp.StatusCode)
+		}
+	}
+	return ret
+}
+
+func (e *APIError) parse(body []byte) {
+	var payload struct {
+		Detail    json.RawMessage `json:"detail,omitempty"`
+		Message   string          `json:"message,omitempty"`
+		Error     string          `json:"error,omitempty"`
+		Type      string          `json:"type,omitempty"`
+		ErrorType string          `json:"error_type,omitempty"`
+	}
+	if err := json.Unmarshal(body, &payload); err != nil {
+		return
+	}
+	if payload.ErrorType != "" {
+		e.Type = payload.ErrorType
+	} else if payload.Type != "" {
+		e.Type = payload.Type
+	}
+	if payload.Message != "" {
+		e.Message = payload.Message
+	} else if payload.Error != "" {
+		e.Message = payload.Error
+	}
+	if len(payload.Detail) == 0 {
+		return
+	}
+	var msg string
+	if err := json.Unmarshal(payload.Detail, &msg); err == nil {
+		if e.Message == "" {
+			e.Message = msg
+		}
+		return
+	}
+	var detail []ValidationError
+	if err := json.Unmarshal(payload.Detail, &detail); err == nil {
+		e.Detail = detail
+	}
+}
+
+func (e *APIError) Error() string {
+	var b strings.Builder
+	b.WriteString("fal api error: ")
+	b.WriteString(fmt.Sprintf("code: %d", e.StatusCode))
+	if e.Type != "" {
+		b.WriteString(", type: ")
+		b.WriteString(e.Type)
+	}
+	b.WriteString(", message: ")
+	b.WriteString(e.Message)
+	for _, v := range e.Detail {
+		b.WriteString("; ")
+		b.WriteString(v.Error())
+	}
+	if e.RequestID != "" {
+		b.WriteString(", request_id: ")
+		b.WriteString(e.RequestID)
+	}
+	return b.String()
+}
+
+// Is matches the sentinel errors by status code
+func (e *APIError) Is(target error) bool {
+	switch target {
+	case ErrUnauthorized:
+		return e.StatusCode == http.StatusUnauthorized || e.StatusCode == http.StatusForbidden
+	case ErrPaymentRequired:
+		return e.StatusCode == http.StatusPaymentRequired
+	case ErrNotFound:
+		return e.StatusCode == http.StatusNotFound
+	case ErrValidation:
+		return e.StatusCode == http.StatusUnprocessableEntity || e.StatusCode == http.StatusBadRequest && len(e.Detail) > 0
+	case ErrRateLimited:
+		return e.StatusCode == http.StatusTooManyRequests
+	}
+	return false
+}
+
+// Retryable reports whether the request may succeed if retried
+func (e *APIError) Retryable() bool {
+	return IsRetryableStatus(e.StatusCode)
+}
+
+// IsRetryableStatus reports whether the http status code is transient
+func IsRetryableStatus(code int) bool {
+	switch code {
+	case http.StatusRequestTimeout,
+		http.StatusTooManyRequests,
+		http.StatusInternalServerError,
+		http.StatusBadGateway,
+		http.StatusServiceUnavailable,
+		http.StatusGatewayTimeout:
+		return true
+	}
+	return false
+}
+
+// IsSuccess reports whether the http status code is 2xx
+func IsSuccess(code int) bool {
+	return code >= 200 && code < 300
+}
@@ -0,0 +1,75 @@
+package falclient
+
+import (
+	"errors"
+	"io"
+	"net/http"
+	"strings"
+	"testing"
+)
+
+func TestAPIError(t *testing.T) {
+	tests := []struct {
+		name    string
+		code    int
+		body    string
+		target  error
+		message string
+		detail  int
+	}{
+		{
+			name:    "unauthorized",
+			code:    http.StatusUnauthorized,
+			body:    `{"detail":"No user found for Key ID and Secret"}`,
+			target:  ErrUnauthorized,
+			message: "No user found for Key ID and Secret",
+		},
+		{
+			name:    "validation",
+			code:    http.StatusUnprocessableEntity,
+			body:    `{"detail":[{"loc":["body","prompt"],"msg":"field required","type":"value_error.missing"}]}`,
+			target:  ErrValidation,
+			message: "field required",
+			detail:  1,
+		},
+		{
+			name:    "rate limited",
+			code:    http.StatusTooManyRequests,
+			body:    `too many requests`,
+			target:  ErrRateLimited,
+			message: "too many requests",
+		},
+		{
+			name:    "not found",
+			code:    http.StatusNotFound,
+			target:  ErrNotFound,
+			message: http.StatusText(http.StatusNotFound),
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			resp := &http.Response{
+				StatusCode: tt.code,
+				Header:     http.Header{RequestIDHeader: []string{"req-1"}},
+				Body:       io.NopCloser(strings.NewReader(tt.body)),
+			}
+			err := error(NewAPIError(resp))
+			if !errors.Is(err, tt.target) {
+				t.Errorf("expect %v, got %v", tt.target, err)
+			}
+			var apiErr *APIError
+			if !errors.As(err, &apiErr) {
+				t.Fatalf("expect *APIError, got %T", err)
+			}
+			if apiErr.Message != tt.message {
+				t.Errorf("expect message %q, got %q", tt.message, apiErr.Message)
+			}
+			if len(apiErr.Detail) != tt.detail {
+				t.Errorf("expect %d detail, got %d", tt.detail, len(apiErr.Detail))
+			}
+			if apiErr.RequestID != "req-1" {
+				t.Errorf("expect request id req-1, got %s", apiErr.RequestID)
+			}
+		})
+	}
+}
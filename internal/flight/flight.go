@@ -0,0 +1,54 @@
+// Package flight shares a call between the concurrent callers asking for the same key
+package flight
+
+import (
+	"context"
+	"sync"
+	"time"
+)
+
+// call in-flight call shared by concurrent callers
+type call[V any] struct {
+	done chan struct{}
+	val  V
+	err  error
+}
+
+// Group runs at most one call per key, the zero value is ready to use
+type Group[K comparable, V any] struct {
+	calls map[K]*call[V]
+	lock  sync.Mutex
+}
+
+// Do runs fn unless a call of the key is in flight and returns the result of the call.
+// The call outlives the caller which started it, other callers may still wait for it,
+// so fn runs with a context detached from ctx and bounded by timeout.
+// A caller whose ctx is done returns its ctx error without waiting for the call
+func (g *Group[K, V]) Do(ctx context.Context, key K, timeout time.Duration, fn func(ctx context.Context) (V, error)) (V, error) {
+	g.lock.Lock()
+	c, ok := g.calls[key]
+	if !ok {
+		if g.calls == nil {
+			g.calls = make(map[K]*call[V])
+		}
+		c = &call[V]{done: make(chan struct{})}
+		g.calls[key] = c
+		go func() {
+			callCtx, cancel := context.WithTimeout(context.WithoutCancel(ctx), timeout)
+			defer cancel()
+			c.val, c.err = fn(callCtx)
+			g.lock.Lock()
+			delete(g.calls, key)
+			g.lock.Unlock()
+			close(c.done)
+		}()
+	}
+	g.lock.Unlock()
+	select {
+	case <-ctx.Done():
+		var zero V
+		return zero, ctx.Err()
+	case <-c.done:
+	}
+	return c.val, c.err
+}
@@ -0,0 +1,61 @@
+package flight
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestGroup(t *testing.T) {
+	var (
+		g     Group[string, int]
+		calls atomic.Int32
+		wg    sync.WaitGroup
+	)
+	release := make(chan struct{})
+	for range 5 {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			v, err := g.Do(context.Background(), "key", time.Second, func(context.Context) (int, error) {
+				<-release
+				return int(calls.Add(1)), nil
+			})
+			if err != nil || v != 1 {
+				t.Errorf("expect the shared result, got %d: %v", v, err)
+			}
+		}()
+	}
+	time.Sleep(10 * time.Millisecond)
+	close(release)
+	wg.Wait()
+	if calls.Load() != 1 {
+		t.Errorf("expect 1 call, got %d", calls.Load())
+	}
+}
+
+func TestGroupTimeout(t *testing.T) {
+	var g Group[string, int]
+	hang := func(ctx context.Context) (int, error) {
+		<-ctx.Done()
+		return 0, ctx.Err()
+	}
+	// the caller gives up, the call goes on until its own timeout
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	if _, err := g.Do(ctx, "key", 20*time.Millisecond, hang); !errors.Is(err, context.Canceled) {
+		t.Fatalf("expect canceled, got %v", err)
+	}
+	if _, err := g.Do(context.Background(), "key", time.Hour, hang); !errors.Is(err, context.DeadlineExceeded) {
+		t.Fatalf("expect the shared call to time out, got %v", err)
+	}
+	v, err := g.Do(context.Background(), "key", time.Second, func(context.Context) (int, error) {
+		return 1, nil
+	})
+	if err != nil || v != 1 {
+		t.Errorf("expect a new call once the hung one timed out, got %d: %v", v, err)
+	}
+}
@@ -12,7 +12,7 @@ func (q *Queue) Cancel(ctx context.Context, endpoint string, requestID string) (
 	if err != nil {
 		return "", err
 	}
-	gw := fmt.Sprintf("%s/%s/requests/%s/cancel", QueueBaseURL, appID.URLString(), requestID)
+	gw := fmt.Sprintf("%s/%s/requests/%s/cancel", q.endpoints.Queue, appID.URLString(), requestID)
 	httpReq, err := http.NewRequestWithContext(ctx, http.MethodPut, gw, nil)
 	if err != nil {
 		return "", err
@@ -0,0 +1,187 @@
+package queue
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"reflect"
+
+	"github.com/coder/websocket"
+	"github.com/vmihailenco/msgpack/v5"
+)
+
+// RealtimeCodec encodes the inputs sent to and decodes the events received from a realtime endpoint
+type RealtimeCodec interface {
+	// MessageType websocket frame type of the encoded messages
+	MessageType() websocket.MessageType
+	Marshal(v any) ([]byte, error)
+	Unmarshal(data []byte, v any) error
+}
+
+var (
+	// JSONCodec encodes realtime messages as json text frames, []byte values are base64 encoded
+	JSONCodec RealtimeCodec = jsonCodec{}
+	// MsgpackCodec encodes realtime messages as msgpack binary frames, []byte values are sent as is.
+	// Struct fields are named after their json tags
+	MsgpackCodec RealtimeCodec = msgpackCodec{}
+)
+
+type jsonCodec struct{}
+
+func (jsonCodec) MessageType() websocket.MessageType {
+	return websocket.MessageText
+}
+
+func (jsonCodec) Marshal(v any) ([]byte, error) {
+	return json.Marshal(v)
+}
+
+func (jsonCodec) Unmarshal(data []byte, v any) error {
+	return json.Unmarshal(data, v)
+}
+
+func (jsonCodec) DecodeEvent(data []byte, ev *WebsocketEvent) error {
+	if err := json.Unmarshal(data, ev); err != nil {
+		return err
+	}
+	ev.Payload = ev.Data
+	return nil
+}
+
+type msgpackCodec struct{}
+
+func (msgpackCodec) MessageType() websocket.MessageType {
+	return websocket.MessageBinary
+}
+
+func (msgpackCodec) Marshal(v any) ([]byte, error) {
+	var buf bytes.Buffer
+	enc := msgpack.NewEncoder(&buf)
+	enc.SetCustomStructTag("json")
+	if err := enc.Encode(v); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+func (msgpackCodec) Unmarshal(data []byte, v any) error {
+	dec := msgpack.NewDecoder(bytes.NewReader(data))
+	dec.SetCustomStructTag("json")
+	return dec.Decode(v)
+}
+
+// msgpackEvent msgpack encoding of WebsocketEvent, the data is kept encoded
+type msgpackEvent struct {
+	Type                   WebsocketEventType `msgpack:"type,omitempty"`
+	RequestID              string             `msgpack:"request_id,omitempty"`
+	Status                 int                `msgpack:"status,omitempty"`
+	Headers                map[string]string  `msgpack:"headers,omitempty"`
+	TimeToFirstByteSeconds float64            `msgpack:"time_to_first_byte_seconds,omitempty"`
+	Error                  string             `msgpack:"error,omitempty"`
+	Reason                 string             `msgpack:"reason,omitempty"`
+	Data                   msgpack.RawMessage `msgpack:"data,omitempty"`
+}
+
+func (msgpackCodec) DecodeEvent(data []byte, ev *WebsocketEvent) error {
+	var v msgpackEvent
+	if err := msgpack.Unmarshal(data, &v); err != nil {
+		return err
+	}
+	*ev = WebsocketEvent{
+		Type:                   v.Type,
+		RequestID:              v.RequestID,
+		Status:                 v.Status,
+		Headers:                v.Headers,
+		TimeToFirstByteSeconds: v.TimeToFirstByteSeconds,
+		Error:                  v.Error,
+		Reason:                 v.Reason,
+		Payload:                v.Data,
+	}
+	return nil
+}
+
+// RealtimeEventDecoder is implemented by codecs decoding the event envelope themselves,
+// DecodeEvent fills ev and keeps the encoded result in ev.Payload.
+// The envelope of a codec without it is decoded into a map and its data is encoded back with Marshal
+type RealtimeEventDecoder interface {
+	DecodeEvent(data []byte, ev *WebsocketEvent) error
+}
+
+// decodeEvent decodes a received frame, control messages are decoded from text and binary frames
+// whatever the codec of the session, a frame without type and data is a bare result
+func decodeEvent(codec RealtimeCodec, typ websocket.MessageType, data []byte) (WebsocketEvent, error) {
+	if typ != codec.MessageType() {
+		codec = JSONCodec
+		if typ == websocket.MessageBinary {
+			codec = MsgpackCodec
+		}
+	}
+	var ev WebsocketEvent
+	if dec, ok := codec.(RealtimeEventDecoder); ok {
+		if err := dec.DecodeEvent(data, &ev); err != nil {
+			return WebsocketEvent{}, err
+		}
+	} else if err := decodeEnvelope(codec, data, &ev); err != nil {
+		return WebsocketEvent{}, err
+	}
+	if ev.Type == "" && len(ev.Payload) == 0 {
+		ev.Payload = data
+		if codec == JSONCodec {
+			ev.Data = data
+		}
+	}
+	ev.codec = codec
+	return ev, nil
+}
+
+// decodeEnvelope decodes the event envelope with a codec not implementing RealtimeEventDecoder
+func decodeEnvelope(codec RealtimeCodec, data []byte, ev *WebsocketEvent) error {
+	var m map[string]any
+	if err := codec.Unmarshal(data, &m); err != nil {
+		return err
+	}
+	ev.Type = WebsocketEventType(stringValue(m["type"]))
+	ev.RequestID = stringValue(m["request_id"])
+	ev.Status = int(numberValue(m["status"]))
+	ev.TimeToFirstByteSeconds = numberValue(m["time_to_first_byte_seconds"])
+	ev.Error = stringValue(m["error"])
+	ev.Reason = stringValue(m["reason"])
+	if headers := reflect.ValueOf(m["headers"]); headers.Kind() == reflect.Map {
+		ev.Headers = make(map[string]string, headers.Len())
+		for iter := headers.MapRange(); iter.Next(); {
+			ev.Headers[fmt.Sprint(iter.Key().Interface())] = stringValue(iter.Value().Interface())
+		}
+	}
+	if v := m["data"]; v != nil {
+		payload, err := codec.Marshal(v)
+		if err != nil {
+			return err
+		}
+		ev.Payload = payload
+	}
+	return nil
+}
+
+// stringValue returns v if it is a string
+func stringValue(v any) string {
+	s, _ := v.(string)
+	return s
+}
+
+// numberValue returns the value of a number of any type decoded by a codec
+func numberValue(v any) float64 {
+	if n, ok := v.(json.Number); ok {
+		f, _ := n.Float64()
+		return f
+	}
+	rv := reflect.ValueOf(v)
+	switch {
+	case rv.CanInt():
+		return float64(rv.Int())
+	case rv.CanUint():
+		return float64(rv.Uint())
+	case rv.CanFloat():
+		return rv.Float()
+	}
+	return 0
+}
@@ -0,0 +1,165 @@
+package queue
+
+import (
+	"bytes"
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/coder/websocket"
+	"github.com/vmihailenco/msgpack/v5"
+)
+
+type codecInput struct {
+	Prompt string `json:"prompt"`
+	Image  []byte `json:"image_bytes,omitempty"`
+}
+
+type codecResult struct {
+	Images []struct {
+		Content     []byte `json:"content"`
+		ContentType string `json:"content_type"`
+	} `json:"images"`
+}
+
+func TestMsgpackCodec(t *testing.T) {
+	image := []byte{0x89, 'P', 'N', 'G', 0x00, 0xff}
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		conn, err := websocket.Accept(w, r, nil)
+		if err != nil {
+			t.Error(err)
+			return
+		}
+		defer conn.CloseNow()
+		typ, data, err := conn.Read(r.Context())
+		if err != nil {
+			t.Error(err)
+			return
+		}
+		var input map[string]any
+		if err := msgpack.Unmarshal(data, &input); err != nil || typ != websocket.MessageBinary {
+			t.Errorf("expect msgpack binary frame, got %v: %v", typ, err)
+		}
+		// binary values are sent without base64 encoding
+		if !bytes.Equal(input["image_bytes"].([]byte), image) || input["prompt"] != "cat" {
+			t.Errorf("unexpected input: %+v", input)
+		}
+		// control messages may come as json text frames
+		conn.Write(r.Context(), websocket.MessageText, []byte(`{"type":"start","request_id":"req-1"}`))
+		result, _ := msgpack.Marshal(map[string]any{
+			"images": []map[string]any{{"content": image, "content_type": "image/png"}},
+		})
+		conn.Write(r.Context(), websocket.MessageBinary, result)
+		end, _ := msgpack.Marshal(map[string]any{"type": "end", "request_id": "req-1", "status": 200})
+		conn.Write(r.Context(), websocket.MessageBinary, end)
+		conn.Close(websocket.StatusNormalClosure, "")
+	}))
+	defer srv.Close()
+
+	q := NewQueue("key", WithEndpoints(Endpoints{WS: srv.URL}))
+	var events []WebsocketEvent
+	for ev, err := range q.RealtimeSeq(context.Background(), "fal-ai/fast-lcm", codecInput{Prompt: "cat", Image: image}, WithCodec(MsgpackCodec)) {
+		if err != nil {
+			t.Fatal(err)
+		}
+		events = append(events, ev)
+	}
+	if len(events) != 3 {
+		t.Fatalf("expect 3 events, got %+v", events)
+	}
+	if events[0].Type != WSStart || events[0].RequestID != "req-1" {
+		t.Errorf("unexpected start event: %+v", events[0])
+	}
+	if events[2].Type != WSEnd || events[2].Status != 200 {
+		t.Errorf("unexpected end event: %+v", events[2])
+	}
+	var result codecResult
+	if err := events[1].Decode(&result); err != nil {
+		t.Fatal(err)
+	}
+	if len(result.Images) != 1 || !bytes.Equal(result.Images[0].Content, image) || result.Images[0].ContentType != "image/png" {
+		t.Errorf("unexpected result: %+v", result)
+	}
+}
+
+func TestJSONCodecDecode(t *testing.T) {
+	ev, err := decodeEvent(JSONCodec, websocket.MessageText, []byte(`{"type":"","data":{"images":[{"content":"iVBORw==","content_type":"image/png"}]}}`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	var result codecResult
+	if err := ev.Decode(&result); err != nil {
+		t.Fatal(err)
+	}
+	if len(result.Images) != 1 || !bytes.Equal(result.Images[0].Content, []byte{0x89, 'P', 'N', 'G'}) {
+		t.Errorf("unexpected result: %+v", result)
+	}
+}
+
+// plainMsgpackCodec custom codec without the envelope decoding hook
+type plainMsgpackCodec struct{}
+
+func (plainMsgpackCodec) MessageType() websocket.MessageType {
+	return websocket.MessageBinary
+}
+
+func (plainMsgpackCodec) Marshal(v any) ([]byte, error) {
+	return msgpack.Marshal(v)
+}
+
+func (plainMsgpackCodec) Unmarshal(data []byte, v any) error {
+	dec := msgpack.NewDecoder(bytes.NewReader(data))
+	dec.SetCustomStructTag("json")
+	return dec.Decode(v)
+}
+
+func TestCustomCodecDecode(t *testing.T) {
+	frame, _ := msgpack.Marshal(map[string]any{
+		"type":       "end",
+		"request_id": "req-1",
+		"status":     uint8(200),
+		"headers":    map[string]string{"x-fal-billable-units": "1"},
+		"data": map[string]any{
+			"images": []map[string]any{{"content": []byte{0x89, 'P', 'N', 'G'}, "content_type": "image/png"}},
+		},
+	})
+	ev, err := decodeEvent(plainMsgpackCodec{}, websocket.MessageBinary, frame)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if ev.Type != WSEnd || ev.RequestID != "req-1" || ev.Status != 200 || ev.Headers["x-fal-billable-units"] != "1" {
+		t.Errorf("unexpected envelope: %+v", ev)
+	}
+	var result codecResult
+	if err := ev.Decode(&result); err != nil {
+		t.Fatal(err)
+	}
+	if len(result.Images) != 1 || !bytes.Equal(result.Images[0].Content, []byte{0x89, 'P', 'N', 'G'}) || result.Images[0].ContentType != "image/png" {
+		t.Errorf("unexpected result: %+v", result)
+	}
+}
+
+func TestErrorEventDecode(t *testing.T) {
+	msgpackFrame, _ := msgpack.Marshal(map[string]any{"type": "error", "request_id": "req-1", "error": "Internal error", "reason": "inference timed out"})
+	for _, tc := range []struct {
+		name  string
+		codec RealtimeCodec
+		typ   websocket.MessageType
+		frame []byte
+	}{
+		{"json", JSONCodec, websocket.MessageText, []byte(`{"type":"error","request_id":"req-1","error":"Internal error","reason":"inference timed out"}`)},
+		{"msgpack", MsgpackCodec, websocket.MessageBinary, msgpackFrame},
+		{"custom", plainMsgpackCodec{}, websocket.MessageBinary, msgpackFrame},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			ev, err := decodeEvent(tc.codec, tc.typ, tc.frame)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if ev.Type != WSError || ev.RequestID != "req-1" || ev.Error != "Internal error" || ev.Reason != "inference timed out" || ev.Err != nil {
+				t.Errorf("unexpected error event: %+v", ev)
+			}
+		})
+	}
+}
@@ -0,0 +1,48 @@
+package queue
+
+import (
+	"fmt"
+	"strings"
+)
+
+// Endpoints base urls used by the queue client
+type Endpoints struct {
+	// Queue queue api base url, default QueueBaseURL
+	Queue string
+	// WS websocket base url, default WSBaseURL
+	WS string
+	// Rest rest api base url, default RestAPIURL
+	Rest string
+}
+
+// DefaultEndpoints returns the public fal.ai endpoints
+func DefaultEndpoints() Endpoints {
+	return Endpoints{
+		Queue: QueueBaseURL,
+		WS:    WSBaseURL,
+		Rest:  RestAPIURL,
+	}
+}
+
+// withDefaults fills the empty endpoints with default values
+func (e Endpoints) withDefaults() Endpoints {
+	def := DefaultEndpoints()
+	if e.Queue == "" {
+		e.Queue = def.Queue
+	}
+	if e.WS == "" {
+		e.WS = def.WS
+	}
+	if e.Rest == "" {
+		e.Rest = def.Rest
+	}
+	e.Queue = strings.TrimRight(e.Queue, "/")
+	e.WS = strings.TrimRight(e.WS, "/")
+	e.Rest = strings.TrimRight(e.Rest, "/")
+	return e
+}
+
+// TokenURL returns the realtime token api url
+func (e Endpoints) TokenURL() string {
+	return fmt.Sprintf("%s/tokens/", e.Rest)
+}
@@ -0,0 +1,62 @@
+package queue
+
+import (
+	"errors"
+	"fmt"
+)
+
+var (
+	// ErrJobFailed the request finished with an error
+	ErrJobFailed = errors.New("job failed")
+	// ErrUnknownStatus the request is in a status unknown to the client
+	ErrUnknownStatus = errors.New("unknown status")
+	// ErrWaitTimeout the request did not finish within the max wait duration
+	ErrWaitTimeout = errors.New("wait timeout")
+	// ErrStreamClosed the status stream ended before a terminal status and could not be resumed
+	ErrStreamClosed = errors.New("status stream closed")
+	// ErrInvalidEvent the status stream sent an event which is not a status
+	ErrInvalidEvent = errors.New("invalid status event")
+)
+
+// JobError error of a request finished with an error status
+type JobError struct {
+	RequestID string     `json:"request_id,omitempty"`
+	Status    StatusType `json:"status,omitempty"`
+	Message   string     `json:"error,omitempty"`
+	Type      string     `json:"error_type,omitempty"`
+}
+
+func (e *JobError) Error() string {
+	msg := e.Message
+	if msg == "" {
+		msg = string(e.Status)
+	}
+	if e.Type != "" {
+		return fmt.Sprintf("job %s failed: %s (%s)", e.RequestID, msg, e.Type)
+	}
+	return fmt.Sprintf("job %s failed: %s", e.RequestID, msg)
+}
+
+func (e *JobError) Is(target error) bool {
+	return target == ErrJobFailed
+}
+
+// checkStatus reports whether the request reached a terminal status,
+// returns a *JobError if it finished with an error
+func checkStatus(status *Status) (bool, error) {
+	switch status.Status {
+	case IN_QUEUE, IN_PROGRESS, CANCELLATION_REQUESTED:
+		return false, nil
+	case COMPLETED, ALREADY_COMPLETED, FAILED, CANCELLED:
+		if status.Failed() {
+			return true, &JobError{
+				RequestID: status.RequestID,
+				Status:    status.Status,
+				Message:   status.Error,
+				Type:      status.ErrorType,
+			}
+		}
+		return true, nil
+	}
+	return false, fmt.Errorf("%w: %s", ErrUnknownStatus, status.Status)
+}
@@ -3,13 +3,13 @@ package queue
 import (
 	"context"
 	"encoding/json"
-	"errors"
 	"fmt"
-	"io"
 	"net/http"
+	"net/url"
 
 	"github.com/coder/websocket"
-	"github.com/tmaxmax/go-sse"
+
+	"github.com/bububa/falclient"
 )
 
 type QueueOption func(*Queue)
@@ -26,11 +26,57 @@ func WithHttpClient(clt *http.Client) QueueOption {
 	}
 }
 
+// WithEndpoints overrides the fal.ai endpoints, empty fields fallback to defaults
+func WithEndpoints(v Endpoints) QueueOption {
+	return func(q *Queue) {
+		q.endpoints = v
+	}
+}
+
+// WithRetryPolicy sets the retry policy of http requests, default falclient.DefaultRetryPolicy
+func WithRetryPolicy(p falclient.RetryPolicy) QueueOption {
+	return func(q *Queue) {
+		q.retry = p
+	}
+}
+
+// WithInputTransformer transforms the input of every submitted request, e.g. *storage.Uploader
+// uploads the binary values of the input and replaces them with their urls
+func WithInputTransformer(t InputTransformer) QueueOption {
+	return func(q *Queue) {
+		q.transformer = t
+	}
+}
+
+// WithRealtimeTokens authorizes websocket connections with short-lived app scoped tokens
+// passed as the fal_jwt_token query parameter instead of the api key
+func WithRealtimeTokens(m *RealtimeTokenManager) QueueOption {
+	return func(q *Queue) {
+		q.tokens = m
+	}
+}
+
+// InputTransformer transforms the request input before it is submitted
+type InputTransformer interface {
+	TransformInput(ctx context.Context, input any) (any, error)
+}
+
+// InputTransformerFunc adapts a func to InputTransformer
+type InputTransformerFunc func(ctx context.Context, input any) (any, error)
+
+func (f InputTransformerFunc) TransformInput(ctx context.Context, input any) (any, error) {
+	return f(ctx, input)
+}
+
 type Queue struct {
 	// token authorized key
-	token string
-	http  *http.Client
-	debug bool
+	token       string
+	http        *http.Client
+	retry       falclient.RetryPolicy
+	transformer InputTransformer
+	tokens      *RealtimeTokenManager
+	endpoints   Endpoints
+	debug       bool
 }
 
 func NewQueue(token string, opts ...QueueOption) *Queue {
@@ -38,9 +84,13 @@ func NewQueue(token string, opts ...QueueOption) *Queue {
 	for _, opt := range opts {
 		opt(ret)
 	}
+	ret.endpoints = ret.endpoints.withDefaults()
 	if ret.http == nil {
 		ret.http = http.DefaultClient
 	}
+	if ret.retry == nil {
+		ret.retry = falclient.DefaultRetryPolicy
+	}
 	return ret
 }
 
@@ -48,17 +98,21 @@ func (q *Queue) SetDebug(v bool) {
 	q.debug = v
 }
 
-func (q *Queue) fetch(_ context.Context, req *http.Request, resp any) error {
+// Endpoints returns the endpoints used by the queue
+func (q *Queue) Endpoints() Endpoints {
+	return q.endpoints
+}
+
+func (q *Queue) fetch(ctx context.Context, req *http.Request, resp any) error {
 	req.Header.Set("Authorization", fmt.Sprintf("Key %s", q.token))
 	req.Header.Set("Content-Type", "application/json")
-	httpResp, err := q.http.Do(req)
+	httpResp, err := falclient.Do(ctx, q.http, req, q.retry)
 	if err != nil {
 		return err
 	}
 	defer httpResp.Body.Close()
-	if httpResp.StatusCode < 200 || httpResp.StatusCode >= 300 {
-		msg, _ := io.ReadAll(httpResp.Body)
-		return errors.New(string(msg))
+	if !falclient.IsSuccess(httpResp.StatusCode) {
+		return falclient.NewAPIError(httpResp)
 	}
 	// bs, _ := io.ReadAll(httpResp.Body)
 	// fmt.Println(string(bs))
@@ -66,42 +120,38 @@ func (q *Queue) fetch(_ context.Context, req *http.Request, resp any) error {
 	return json.NewDecoder(httpResp.Body).Decode(resp)
 }
 
-func (q *Queue) SSE(ctx context.Context, req *http.Request) (<-chan Status, error) {
-	req.Header.Set("Authorization", fmt.Sprintf("Key %s", q.token))
-	req.Header.Set("Content-Type", "application/json")
-	httpResp, err := q.http.Do(req)
-	if err != nil {
-		return nil, err
-	}
-	ch := make(chan Status)
-	go func() {
-		defer httpResp.Body.Close()
-		defer close(ch)
-		for ev, err := range sse.Read(httpResp.Body, nil) {
-			if err != nil {
-				// handle read error
-				break // can end the loop as Read stops on first error anyway
-			}
-			if data := ev.Data; data != "" {
-				var item Status
-				if err := json.Unmarshal([]byte(data), &item); err == nil {
-					ch <- item
-				}
-			}
-		}
-	}()
-	return ch, nil
+// RealtimeTokens returns the realtime token manager set by WithRealtimeTokens, nil if websockets use the api key
+func (q *Queue) RealtimeTokens() *RealtimeTokenManager {
+	return q.tokens
 }
 
 func (q *Queue) WS(ctx context.Context, appID string) (*websocket.Conn, error) {
-	header := make(http.Header)
-	header.Set("Authorization", fmt.Sprintf("Key %s", q.token))
-	conn, _, err := websocket.Dial(ctx, fmt.Sprintf("%s/%s", WSBaseURL, appID), &websocket.DialOptions{
-		HTTPClient: q.http,
-		HTTPHeader: header,
-	})
+	if q.tokens == nil {
+		header := make(http.Header)
+		header.Set("Authorization", fmt.Sprintf("Key %s", q.token))
+		conn, _, err := websocket.Dial(ctx, fmt.Sprintf("%s/%s", q.endpoints.WS, appID), &websocket.DialOptions{
+			HTTPClient: q.http,
+			HTTPHeader: header,
+		})
+		return conn, err
+	}
+	conn, resp, err := q.dialWithToken(ctx, appID)
+	if resp != nil && (resp.StatusCode == http.StatusUnauthorized || resp.StatusCode == http.StatusForbidden) {
+		// the cached token was rejected, retry once with a fresh one
+		q.tokens.Invalidate(appID)
+		conn, _, err = q.dialWithToken(ctx, appID)
+	}
+	return conn, err
+}
+
+// dialWithToken connects to the app with a realtime token
+func (q *Queue) dialWithToken(ctx context.Context, appID string) (*websocket.Conn, *http.Response, error) {
+	token, err := q.tokens.Token(ctx, appID)
 	if err != nil {
-		return nil, err
+		return nil, nil, err
 	}
-	return conn, nil
+	query := url.Values{realtimeTokenParam: {token.Token}}
+	return websocket.Dial(ctx, fmt.Sprintf("%s/%s?%s", q.endpoints.WS, appID, query.Encode()), &websocket.DialOptions{
+		HTTPClient: q.http,
+	})
 }
@@ -2,14 +2,55 @@ package queue
 
 import (
 	"context"
-	"errors"
-	"io"
+	"fmt"
+	"iter"
 
 	"github.com/coder/websocket"
-	"github.com/coder/websocket/wsjson"
 )
 
-func (q *Queue) Realtime(ctx context.Context, endpoint string, input any) (<-chan WebsocketEvent, error) {
+// Realtime sends the input to the realtime endpoint and streams the received events,
+// read and decode failures are delivered as events with only Err set, the channel is closed when the connection ends.
+// WithCodec and WithReadLimit apply to the connection
+func (q *Queue) Realtime(ctx context.Context, endpoint string, input any, opts ...RealtimeOption) (<-chan WebsocketEvent, error) {
+	cfg := newRealtimeConfig(opts)
+	conn, err := q.dialRealtime(ctx, endpoint, input, cfg)
+	if err != nil {
+		return nil, err
+	}
+	ch := make(chan WebsocketEvent)
+	go func() {
+		defer close(ch)
+		readRealtime(ctx, conn, cfg.codec, func(ev WebsocketEvent, err error) bool {
+			if err != nil {
+				ev = WebsocketEvent{Err: err}
+			}
+			select {
+			case ch <- ev:
+				return true
+			case <-ctx.Done():
+				return false
+			}
+		})
+	}()
+	return ch, nil
+}
+
+// RealtimeSeq sends the input to the realtime endpoint and iterates the received events,
+// breaking the loop closes the websocket. WithCodec and WithReadLimit apply to the connection
+func (q *Queue) RealtimeSeq(ctx context.Context, endpoint string, input any, opts ...RealtimeOption) iter.Seq2[WebsocketEvent, error] {
+	return func(yield func(WebsocketEvent, error) bool) {
+		cfg := newRealtimeConfig(opts)
+		conn, err := q.dialRealtime(ctx, endpoint, input, cfg)
+		if err != nil {
+			yield(WebsocketEvent{}, err)
+			return
+		}
+		readRealtime(ctx, conn, cfg.codec, yield)
+	}
+}
+
+// dialRealtime connects to the realtime endpoint and sends the input
+func (q *Queue) dialRealtime(ctx context.Context, endpoint string, input any, cfg realtimeConfig) (*websocket.Conn, error) {
 	appID, err := AppIDFromEndpoint(endpoint)
 	if err != nil {
 		return nil, err
@@ -18,25 +59,42 @@ func (q *Queue) Realtime(ctx context.Context, endpoint string, input any) (<-cha
 	if err != nil {
 		return nil, err
 	}
-	defer conn.CloseNow()
-	if err := wsjson.Write(ctx, conn, input); err != nil {
+	conn.SetReadLimit(cfg.readLimit)
+	if err := writeRealtime(ctx, conn, cfg.codec, input); err != nil {
+		conn.CloseNow()
 		return nil, err
 	}
-	ch := make(chan WebsocketEvent)
-	go func() {
-		defer close(ch)
-		for {
-			var ev WebsocketEvent
-			if err := wsjson.Read(ctx, conn, &ev); err != nil {
-				if errors.Is(err, io.EOF) {
-					ch <- WebsocketEvent{Type: WSError, Err: err}
-					break
-				} else {
-					conn.Close(websocket.StatusAbnormalClosure, err.Error())
-				}
+	return conn, nil
+}
+
+// writeRealtime encodes the input with the codec and sends it
+func writeRealtime(ctx context.Context, conn *websocket.Conn, codec RealtimeCodec, input any) error {
+	data, err := codec.Marshal(input)
+	if err != nil {
+		return fmt.Errorf("encode realtime input: %w", err)
+	}
+	return conn.Write(ctx, codec.MessageType(), data)
+}
+
+// readRealtime yields the events of the connection until it is closed, fails or yield returns false,
+// a malformed message is yielded as an error without ending the connection
+func readRealtime(ctx context.Context, conn *websocket.Conn, codec RealtimeCodec, yield func(WebsocketEvent, error) bool) {
+	defer conn.CloseNow()
+	for {
+		typ, data, err := conn.Read(ctx)
+		if err != nil {
+			if websocket.CloseStatus(err) != websocket.StatusNormalClosure {
+				yield(WebsocketEvent{}, err)
 			}
-			ch <- ev
+			return
 		}
-	}()
-	return ch, nil
+		ev, err := decodeEvent(codec, typ, data)
+		if err != nil {
+			err = fmt.Errorf("decode realtime event: %w", err)
+		}
+		if !yield(ev, err) {
+			conn.Close(websocket.StatusNormalClosure, "")
+			return
+		}
+	}
 }
@@ -0,0 +1,101 @@
+package queue
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/coder/websocket"
+	"github.com/coder/websocket/wsjson"
+)
+
+func TestRealtimeSeq(t *testing.T) {
+	closed := make(chan websocket.StatusCode, 1)
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/fal-ai/flux" {
+			t.Errorf("unexpected path: %s", r.URL.Path)
+		}
+		conn, err := websocket.Accept(w, r, nil)
+		if err != nil {
+			t.Error(err)
+			return
+		}
+		defer conn.CloseNow()
+		var input map[string]string
+		if err := wsjson.Read(r.Context(), conn, &input); err != nil {
+			t.Error(err)
+			return
+		}
+		for _, typ := range []WebsocketEventType{WSStart, "", WSEnd} {
+			wsjson.Write(r.Context(), conn, WebsocketEvent{Type: typ, RequestID: "req-1", Data: json.RawMessage(`{"prompt":"` + input["prompt"] + `"}`)})
+		}
+		// the client closes the websocket when the loop breaks
+		_, _, err = conn.Read(r.Context())
+		closed <- websocket.CloseStatus(err)
+	}))
+	defer srv.Close()
+
+	q := NewQueue("key", WithEndpoints(Endpoints{WS: srv.URL}))
+	var events []WebsocketEvent
+	for ev, err := range q.RealtimeSeq(context.Background(), "fal-ai/flux/dev", map[string]string{"prompt": "cat"}) {
+		if err != nil {
+			t.Fatal(err)
+		}
+		events = append(events, ev)
+		if ev.Type == WSEnd {
+			break
+		}
+	}
+	if len(events) != 3 || string(events[1].Data) != `{"prompt":"cat"}` {
+		t.Errorf("unexpected events: %+v", events)
+	}
+	select {
+	case code := <-closed:
+		if code != websocket.StatusNormalClosure {
+			t.Errorf("expect normal closure, got %v", code)
+		}
+	case <-time.After(time.Second):
+		t.Error("websocket not closed after break")
+	}
+}
+
+func TestRealtime(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		conn, err := websocket.Accept(w, r, nil)
+		if err != nil {
+			t.Error(err)
+			return
+		}
+		defer conn.CloseNow()
+		var input map[string]string
+		if err := wsjson.Read(r.Context(), conn, &input); err != nil {
+			t.Error(err)
+			return
+		}
+		for _, typ := range []WebsocketEventType{WSStart, WSEnd} {
+			wsjson.Write(r.Context(), conn, WebsocketEvent{Type: typ, RequestID: "req-1"})
+		}
+		conn.Close(websocket.StatusPolicyViolation, "quota exceeded")
+	}))
+	defer srv.Close()
+
+	q := NewQueue("key", WithEndpoints(Endpoints{WS: srv.URL}))
+	ch, err := q.Realtime(context.Background(), "fal-ai/flux", map[string]string{"prompt": "cat"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	// the connection outlives Realtime and the channel ends with the close error
+	var events []WebsocketEvent
+	for ev := range ch {
+		events = append(events, ev)
+	}
+	if len(events) != 3 || events[0].Type != WSStart || events[1].Type != WSEnd {
+		t.Fatalf("unexpected events: %+v", events)
+	}
+	if last := events[2]; last.Type != "" || websocket.CloseStatus(last.Err) != websocket.StatusPolicyViolation {
+		t.Errorf("expect policy violation error event, got %+v", last)
+	}
+}
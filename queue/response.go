@@ -12,7 +12,7 @@ func (q *Queue) Response(ctx context.Context, endpoint string, requestID string,
 	if err != nil {
 		return err
 	}
-	gw := fmt.Sprintf("%s/%s/requests/%s", QueueBaseURL, appID.URLString(), requestID)
+	gw := fmt.Sprintf("%s/%s/requests/%s", q.endpoints.Queue, appID.URLString(), requestID)
 	httpReq, err := http.NewRequestWithContext(ctx, http.MethodGet, gw, nil)
 	if err != nil {
 		return err
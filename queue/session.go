@@ -0,0 +1,310 @@
+package queue
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/coder/websocket"
+)
+
+var (
+	// ErrSessionClosed the realtime session is closed
+	ErrSessionClosed = errors.New("realtime session closed")
+	// ErrEventBufferFull the consumer of a realtime session fell too far behind
+	ErrEventBufferFull = errors.New("realtime event buffer full")
+)
+
+const (
+	// DefaultPingInterval default interval between keepalive pings of a realtime session
+	DefaultPingInterval = 30 * time.Second
+	// DefaultRealtimeReadLimit default max size of a realtime message
+	DefaultRealtimeReadLimit = 32 << 20
+	// DefaultEventBuffer default max number of received events waiting for the consumer of a realtime session
+	DefaultEventBuffer = 64
+)
+
+// pingTimeout max duration to wait for a pong
+var pingTimeout = 10 * time.Second
+
+// realtimeConfig configuration of a realtime session
+type realtimeConfig struct {
+	pingInterval time.Duration
+	readLimit    int64
+	buffer       int
+	codec        RealtimeCodec
+}
+
+// newRealtimeConfig returns the configuration with the options applied
+func newRealtimeConfig(opts []RealtimeOption) realtimeConfig {
+	cfg := realtimeConfig{
+		pingInterval: DefaultPingInterval,
+		readLimit:    DefaultRealtimeReadLimit,
+		buffer:       DefaultEventBuffer,
+		codec:        JSONCodec,
+	}
+	for _, opt := range opts {
+		opt(&cfg)
+	}
+	if cfg.buffer <= 0 {
+		cfg.buffer = DefaultEventBuffer
+	}
+	return cfg
+}
+
+// RealtimeOption configures a realtime session or connection
+type RealtimeOption func(*realtimeConfig)
+
+// WithCodec sets the encoding of the realtime messages, default JSONCodec
+func WithCodec(c RealtimeCodec) RealtimeOption {
+	return func(cfg *realtimeConfig) {
+		cfg.codec = c
+	}
+}
+
+// WithPingInterval sets the interval between keepalive pings of a session, default DefaultPingInterval, <= 0 disables pings
+func WithPingInterval(d time.Duration) RealtimeOption {
+	return func(c *realtimeConfig) {
+		c.pingInterval = d
+	}
+}
+
+// WithReadLimit sets the max size of a received message, default DefaultRealtimeReadLimit, -1 disables the limit
+func WithReadLimit(n int64) RealtimeOption {
+	return func(c *realtimeConfig) {
+		c.readLimit = n
+	}
+}
+
+// WithEventBuffer sets the max number of received events waiting for the consumer, default DefaultEventBuffer.
+// The events are queued so that the connection keeps being read, a session whose consumer falls
+// further behind ends with ErrEventBufferFull
+func WithEventBuffer(n int) RealtimeOption {
+	return func(c *realtimeConfig) {
+		c.buffer = n
+	}
+}
+
+// RealtimeSession long-lived websocket connection to a realtime endpoint.
+// Inputs are sent with Send and the results are received from Events,
+// the session lives until Close is called, the connection fails or the context of NewRealtimeSession is done
+type RealtimeSession struct {
+	conn        *websocket.Conn
+	parent      context.Context
+	ctx         context.Context
+	cancel      context.CancelCauseFunc
+	codec       RealtimeCodec
+	events      chan WebsocketEvent
+	done        chan struct{}
+	stop        chan struct{}
+	err         error
+	closing     bool
+	lock        sync.Mutex
+	pending     []WebsocketEvent
+	limit       int
+	notify      chan struct{}
+	pendingLock sync.Mutex
+}
+
+// NewRealtimeSession connects to the realtime endpoint, ctx bounds the lifetime of the session
+func (q *Queue) NewRealtimeSession(ctx context.Context, endpoint string, opts ...RealtimeOption) (*RealtimeSession, error) {
+	cfg := newRealtimeConfig(opts)
+	appID, err := AppIDFromEndpoint(endpoint)
+	if err != nil {
+		return nil, err
+	}
+	conn, err := q.WS(ctx, appID.URLString())
+	if err != nil {
+		return nil, err
+	}
+	conn.SetReadLimit(cfg.readLimit)
+	sessionCtx, cancel := context.WithCancelCause(ctx)
+	s := &RealtimeSession{
+		conn:   conn,
+		codec:  cfg.codec,
+		parent: ctx,
+		ctx:    sessionCtx,
+		cancel: cancel,
+		events: make(chan WebsocketEvent),
+		limit:  cfg.buffer,
+		done:   make(chan struct{}),
+		stop:   make(chan struct{}),
+		notify: make(chan struct{}, 1),
+	}
+	go s.read()
+	go s.dispatch()
+	if cfg.pingInterval > 0 {
+		go s.keepalive(cfg.pingInterval)
+	}
+	return s, nil
+}
+
+// Send encodes the input with the codec of the session and sends it to the endpoint
+func (s *RealtimeSession) Send(ctx context.Context, input any) error {
+	select {
+	case <-s.done:
+		return errors.Join(ErrSessionClosed, s.Err())
+	default:
+	}
+	if err := writeRealtime(ctx, s.conn, s.codec, input); err != nil {
+		if s.ctx.Err() != nil {
+			return errors.Join(ErrSessionClosed, err)
+		}
+		return err
+	}
+	return nil
+}
+
+// Events returns the received events, the channel is closed when the session ends
+// and the events received before are delivered
+func (s *RealtimeSession) Events() <-chan WebsocketEvent {
+	return s.events
+}
+
+// Done is closed when the session ends and the events channel is closed
+func (s *RealtimeSession) Done() <-chan struct{} {
+	return s.done
+}
+
+// Err returns the reason the session ended, nil while the session is alive or after a normal closure.
+// A closure by the server is reported as a websocket.CloseError carrying the close code and reason
+func (s *RealtimeSession) Err() error {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	return s.err
+}
+
+// Close closes the connection with a normal closure and waits for the reader to stop
+func (s *RealtimeSession) Close() error {
+	select {
+	case <-s.done:
+		return nil
+	default:
+	}
+	s.lock.Lock()
+	if !s.closing {
+		s.closing = true
+		close(s.stop)
+	}
+	s.lock.Unlock()
+	err := s.conn.Close(websocket.StatusNormalClosure, "")
+	s.cancel(ErrSessionClosed)
+	<-s.done
+	return err
+}
+
+// read queues the received events until the connection ends or the queue is full, it never waits for
+// the consumer so the pongs of the keepalive pings are read while a slow consumer holds the events back
+func (s *RealtimeSession) read() {
+	defer close(s.notify)
+	for {
+		typ, data, err := s.conn.Read(s.ctx)
+		if err != nil {
+			s.finish(err)
+			return
+		}
+		ev, err := decodeEvent(s.codec, typ, data)
+		if err != nil {
+			// a malformed message does not break the connection
+			ev = WebsocketEvent{Err: fmt.Errorf("decode realtime event: %w", err)}
+		}
+		s.pendingLock.Lock()
+		if len(s.pending) >= s.limit {
+			s.pendingLock.Unlock()
+			s.finish(fmt.Errorf("%w: %d events", ErrEventBufferFull, s.limit))
+			return
+		}
+		s.pending = append(s.pending, ev)
+		s.pendingLock.Unlock()
+		select {
+		case s.notify <- struct{}{}:
+		default:
+		}
+	}
+}
+
+// dispatch delivers the queued events to the consumer. The events received before the connection ended
+// are still delivered, Close or the end of the context of the session abandons them
+func (s *RealtimeSession) dispatch() {
+	defer close(s.done)
+	defer close(s.events)
+	reading := true
+	for {
+		s.pendingLock.Lock()
+		if len(s.pending) == 0 {
+			s.pendingLock.Unlock()
+			if !reading {
+				return
+			}
+			select {
+			case _, reading = <-s.notify:
+			case <-s.stop:
+				s.abandon()
+				return
+			case <-s.parent.Done():
+				s.abandon()
+				return
+			}
+			continue
+		}
+		ev := s.pending[0]
+		s.pending[0] = WebsocketEvent{}
+		s.pending = s.pending[1:]
+		s.pendingLock.Unlock()
+		select {
+		case s.events <- ev:
+		case <-s.stop:
+			s.abandon()
+			return
+		case <-s.parent.Done():
+			s.abandon()
+			return
+		}
+	}
+}
+
+// abandon waits for the reader to stop and drops the undelivered events
+func (s *RealtimeSession) abandon() {
+	for range s.notify {
+	}
+	s.pendingLock.Lock()
+	s.pending = nil
+	s.pendingLock.Unlock()
+}
+
+// keepalive pings the server until the session ends, a missing pong ends the session
+func (s *RealtimeSession) keepalive(interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-s.ctx.Done():
+			return
+		case <-ticker.C:
+		}
+		ctx, cancel := context.WithTimeout(s.ctx, pingTimeout)
+		err := s.conn.Ping(ctx)
+		cancel()
+		if err != nil && s.ctx.Err() == nil {
+			s.cancel(fmt.Errorf("realtime ping: %w", err))
+			s.conn.CloseNow()
+			return
+		}
+	}
+}
+
+// finish records the reason the session ended
+func (s *RealtimeSession) finish(err error) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	// the first cause wins: the parent context, a failed ping or the read error
+	s.cancel(err)
+	if s.closing || websocket.CloseStatus(err) == websocket.StatusNormalClosure {
+		s.err = nil
+	} else {
+		s.err = context.Cause(s.ctx)
+	}
+	s.conn.CloseNow()
+}
@@ -0,0 +1,183 @@
+package queue
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/coder/websocket"
+	"github.com/coder/websocket/wsjson"
+)
+
+// newRealtimeServer answers every input with an event echoing it, or the requested malformed message, until the input asks to close the connection
+func newRealtimeServer(t *testing.T) *httptest.Server {
+	t.Helper()
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		conn, err := websocket.Accept(w, r, nil)
+		if err != nil {
+			t.Error(err)
+			return
+		}
+		defer conn.CloseNow()
+		for {
+			var input map[string]string
+			if err := wsjson.Read(r.Context(), conn, &input); err != nil {
+				return
+			}
+			if input["malformed"] != "" {
+				conn.Write(r.Context(), websocket.MessageText, []byte(input["malformed"]))
+				continue
+			}
+			if input["close"] != "" {
+				conn.Close(websocket.StatusPolicyViolation, input["close"])
+				return
+			}
+			wsjson.Write(r.Context(), conn, WebsocketEvent{Type: WSEnd, RequestID: input["prompt"]})
+		}
+	}))
+	t.Cleanup(srv.Close)
+	return srv
+}
+
+func TestRealtimeSession(t *testing.T) {
+	srv := newRealtimeServer(t)
+	q := NewQueue("key", WithEndpoints(Endpoints{WS: srv.URL}))
+	ctx := context.Background()
+	s, err := q.NewRealtimeSession(ctx, "fal-ai/fast-lcm", WithPingInterval(5*time.Millisecond))
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, prompt := range []string{"cat", "dog"} {
+		if err := s.Send(ctx, map[string]string{"prompt": prompt}); err != nil {
+			t.Fatal(err)
+		}
+		// the keepalive pings do not disturb the session
+		time.Sleep(20 * time.Millisecond)
+		if ev := <-s.Events(); ev.RequestID != prompt {
+			t.Errorf("expect event of %s, got %+v", prompt, ev)
+		}
+	}
+	// a malformed message is a local failure, not an error sent by the server
+	if err := s.Send(ctx, map[string]string{"malformed": "{"}); err != nil {
+		t.Fatal(err)
+	}
+	if ev := <-s.Events(); ev.Err == nil || ev.Type != "" {
+		t.Errorf("expect local decode failure, got %+v", ev)
+	}
+	if err := s.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := <-s.Events(); ok {
+		t.Error("events should be closed")
+	}
+	if err := s.Err(); err != nil {
+		t.Errorf("expect no error after close, got %v", err)
+	}
+	if err := s.Send(ctx, map[string]string{"prompt": "cat"}); !errors.Is(err, ErrSessionClosed) {
+		t.Errorf("expect session closed, got %v", err)
+	}
+}
+
+func TestRealtimeSessionSlowConsumer(t *testing.T) {
+	timeout := pingTimeout
+	pingTimeout = 50 * time.Millisecond
+	t.Cleanup(func() { pingTimeout = timeout })
+	srv := newRealtimeServer(t)
+	q := NewQueue("key", WithEndpoints(Endpoints{WS: srv.URL}))
+	ctx := context.Background()
+	s, err := q.NewRealtimeSession(ctx, "fal-ai/fast-lcm", WithPingInterval(10*time.Millisecond))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+	if err := s.Send(ctx, map[string]string{"prompt": "cat"}); err != nil {
+		t.Fatal(err)
+	}
+	// the pongs are read while the event waits for the consumer
+	time.Sleep(200 * time.Millisecond)
+	select {
+	case <-s.Done():
+		t.Fatalf("session ended while the consumer was busy: %v", s.Err())
+	default:
+	}
+	if err := s.Send(ctx, map[string]string{"prompt": "dog"}); err != nil {
+		t.Fatal(err)
+	}
+	for _, prompt := range []string{"cat", "dog"} {
+		if ev := <-s.Events(); ev.RequestID != prompt {
+			t.Errorf("expect event of %s, got %+v", prompt, ev)
+		}
+	}
+}
+
+func TestRealtimeSessionBufferFull(t *testing.T) {
+	srv := newRealtimeServer(t)
+	q := NewQueue("key", WithEndpoints(Endpoints{WS: srv.URL}))
+	ctx := context.Background()
+	s, err := q.NewRealtimeSession(ctx, "fal-ai/fast-lcm", WithEventBuffer(2))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+	// the consumer never reads, the queued events are bounded
+	for range 10 {
+		if err := s.Send(ctx, map[string]string{"prompt": "cat"}); err != nil {
+			break
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	var events int
+	for range s.Events() {
+		events++
+	}
+	if events == 0 || events > 3 {
+		t.Errorf("expect the queued events delivered, got %d", events)
+	}
+	if !errors.Is(s.Err(), ErrEventBufferFull) {
+		t.Errorf("expect event buffer full, got %v", s.Err())
+	}
+}
+
+func TestRealtimeSessionEnd(t *testing.T) {
+	srv := newRealtimeServer(t)
+	q := NewQueue("key", WithEndpoints(Endpoints{WS: srv.URL}))
+
+	s, err := q.NewRealtimeSession(context.Background(), "fal-ai/fast-lcm")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := s.Send(context.Background(), map[string]string{"prompt": "cat"}); err != nil {
+		t.Fatal(err)
+	}
+	if err := s.Send(context.Background(), map[string]string{"close": "quota exceeded"}); err != nil {
+		t.Fatal(err)
+	}
+	// the events received before the server closed the connection are delivered
+	if ev := <-s.Events(); ev.RequestID != "cat" {
+		t.Errorf("expect event of cat, got %+v", ev)
+	}
+	<-s.Done()
+	var closeErr websocket.CloseError
+	if !errors.As(s.Err(), &closeErr) || closeErr.Code != websocket.StatusPolicyViolation || closeErr.Reason != "quota exceeded" {
+		t.Errorf("expect policy violation close error, got %v", s.Err())
+	}
+
+	// the session ends with the context it was created with
+	ctx, cancel := context.WithCancel(context.Background())
+	s, err = q.NewRealtimeSession(ctx, "fal-ai/fast-lcm")
+	if err != nil {
+		t.Fatal(err)
+	}
+	cancel()
+	select {
+	case <-s.Done():
+	case <-time.After(time.Second):
+		t.Fatal("session not ended after cancellation")
+	}
+	if !errors.Is(s.Err(), context.Canceled) {
+		t.Errorf("expect context canceled, got %v", s.Err())
+	}
+}
@@ -0,0 +1,175 @@
+package queue
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"iter"
+	"net/http"
+	"time"
+
+	"github.com/tmaxmax/go-sse"
+
+	"github.com/bububa/falclient"
+)
+
+// StatusEvent event of a status stream, Err is set on the last event when the stream failed
+type StatusEvent struct {
+	Status
+	Err error `json:"-"`
+}
+
+// SSE streams the statuses sent by the server-sent events endpoint of the request until a terminal status.
+// The non-2xx response of the first request is returned as error, later failures end the channel,
+// use SSEEvents to receive them
+func (q *Queue) SSE(ctx context.Context, req *http.Request) (<-chan Status, error) {
+	events, err := q.SSEEvents(ctx, req)
+	if err != nil {
+		return nil, err
+	}
+	ch := make(chan Status)
+	go func() {
+		defer close(ch)
+		for ev := range events {
+			if ev.Err != nil {
+				continue
+			}
+			select {
+			case ch <- ev.Status:
+			case <-ctx.Done():
+				// events is closed once the stream observes the cancellation
+			}
+		}
+	}()
+	return ch, nil
+}
+
+// SSEEvents streams the statuses of the server-sent events endpoint with their errors.
+// Interrupted streams are resumed with Last-Event-ID following the queue retry policy,
+// the channel is closed after a terminal status, an error event or the cancellation of ctx
+func (q *Queue) SSEEvents(ctx context.Context, req *http.Request) (<-chan StatusEvent, error) {
+	resp, err := q.connectSSE(ctx, req, "")
+	if err != nil {
+		return nil, err
+	}
+	ch := make(chan StatusEvent)
+	go func() {
+		defer close(ch)
+		q.readSSE(ctx, req, resp, func(status Status, err error) bool {
+			select {
+			case ch <- StatusEvent{Status: status, Err: err}:
+				return true
+			case <-ctx.Done():
+				return false
+			}
+		})
+	}()
+	return ch, nil
+}
+
+// connectSSE sends the stream request, resuming after lastEventID when set
+func (q *Queue) connectSSE(ctx context.Context, req *http.Request, lastEventID string) (*http.Response, error) {
+	req = req.Clone(ctx)
+	req.Header.Set("Authorization", fmt.Sprintf("Key %s", q.token))
+	req.Header.Set("Accept", "text/event-stream")
+	if lastEventID != "" {
+		req.Header.Set("Last-Event-ID", lastEventID)
+	}
+	resp, err := falclient.Do(ctx, q.http, req, q.retry)
+	if err != nil {
+		return nil, err
+	}
+	if !falclient.IsSuccess(resp.StatusCode) {
+		defer resp.Body.Close()
+		return nil, falclient.NewAPIError(resp)
+	}
+	return resp, nil
+}
+
+// readSSE yields the statuses of the stream until a terminal status, reconnecting when the stream ends early.
+// Errors are yielded with a zero status, the stream stops after any error but invalid events
+func (q *Queue) readSSE(ctx context.Context, req *http.Request, resp *http.Response, yield func(Status, error) bool) {
+	var (
+		lastEventID string
+		attempt     int
+	)
+	for {
+		var readErr error
+		for ev, err := range sse.Read(resp.Body, nil) {
+			if err != nil {
+				readErr = err
+				break
+			}
+			if ev.LastEventID != "" {
+				lastEventID = ev.LastEventID
+			}
+			if ev.Data == "" {
+				continue
+			}
+			var status Status
+			if err := json.Unmarshal([]byte(ev.Data), &status); err != nil {
+				if !yield(Status{}, fmt.Errorf("%w: %w", ErrInvalidEvent, err)) {
+					resp.Body.Close()
+					return
+				}
+				continue
+			}
+			attempt = 0
+			if !yield(status, nil) || status.Status.IsTerminal() {
+				resp.Body.Close()
+				return
+			}
+		}
+		resp.Body.Close()
+		if err := ctx.Err(); err != nil {
+			yield(Status{}, err)
+			return
+		}
+		if readErr == nil {
+			readErr = io.ErrUnexpectedEOF
+		}
+		// the stream ended before a terminal status
+		var err error
+		for {
+			attempt++
+			delay, retry := q.retry.Backoff(attempt, req, nil, readErr)
+			if !retry {
+				yield(Status{}, errors.Join(ErrStreamClosed, readErr))
+				return
+			}
+			timer := time.NewTimer(delay)
+			select {
+			case <-ctx.Done():
+				timer.Stop()
+				yield(Status{}, ctx.Err())
+				return
+			case <-timer.C:
+			}
+			if resp, err = q.connectSSE(ctx, req, lastEventID); err == nil {
+				break
+			}
+			var apiErr *falclient.APIError
+			if errors.As(err, &apiErr) && !apiErr.Retryable() {
+				yield(Status{}, err)
+				return
+			}
+			readErr = err
+		}
+	}
+}
+
+// SSESeq iterates the statuses sent by the server-sent events endpoint of the request until a terminal status.
+// Interrupted streams are resumed like SSEEvents, errors end the loop but invalid events,
+// breaking the loop closes the response body
+func (q *Queue) SSESeq(ctx context.Context, req *http.Request) iter.Seq2[Status, error] {
+	return func(yield func(Status, error) bool) {
+		resp, err := q.connectSSE(ctx, req, "")
+		if err != nil {
+			yield(Status{}, err)
+			return
+		}
+		q.readSSE(ctx, req, resp, yield)
+	}
+}
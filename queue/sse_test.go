@@ -0,0 +1,145 @@
+package queue
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/bububa/falclient"
+)
+
+// writeEvent writes a status server-sent event
+func writeEvent(w http.ResponseWriter, id string, status StatusType) {
+	fmt.Fprintf(w, "id: %s\ndata: {\"request_id\":\"req-1\",\"status\":%q}\n\n", id, status)
+	w.(http.Flusher).Flush()
+}
+
+func TestStreamReconnect(t *testing.T) {
+	var (
+		conns       atomic.Int32
+		lastEventID atomic.Value
+	)
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/event-stream")
+		if conns.Add(1) == 1 {
+			writeEvent(w, "1", IN_QUEUE)
+			w.Write([]byte("data: not json\n\n"))
+			// the connection drops before the terminal status
+			return
+		}
+		lastEventID.Store(r.Header.Get("Last-Event-ID"))
+		writeEvent(w, "2", IN_PROGRESS)
+		writeEvent(w, "3", COMPLETED)
+		// the client stops reading after the terminal status
+		<-r.Context().Done()
+	}))
+	defer srv.Close()
+
+	q := NewQueue("key", WithEndpoints(Endpoints{Queue: srv.URL}), WithRetryPolicy(&falclient.BackoffPolicy{MaxAttempts: 3, BaseDelay: time.Millisecond}))
+	ch, err := q.StreamEvents(context.Background(), "fal-ai/flux/dev", "req-1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	var (
+		statuses []StatusType
+		invalid  int
+	)
+	for ev := range ch {
+		if errors.Is(ev.Err, ErrInvalidEvent) {
+			invalid++
+			continue
+		} else if ev.Err != nil {
+			t.Fatal(ev.Err)
+		}
+		statuses = append(statuses, ev.Status.Status)
+	}
+	if fmt.Sprint(statuses) != "[IN_QUEUE IN_PROGRESS COMPLETED]" {
+		t.Errorf("unexpected statuses: %v", statuses)
+	}
+	if invalid != 1 {
+		t.Errorf("expect 1 invalid event, got %d", invalid)
+	}
+	if v := lastEventID.Load(); v != "1" {
+		t.Errorf("expect Last-Event-ID 1, got %v", v)
+	}
+}
+
+func TestStreamErrors(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/fal-ai/flux/requests/missing/status/stream" {
+			w.WriteHeader(http.StatusNotFound)
+			w.Write([]byte(`{"detail":"request not found"}`))
+			return
+		}
+		w.Header().Set("Content-Type", "text/event-stream")
+		writeEvent(w, "1", IN_QUEUE)
+		<-r.Context().Done()
+	}))
+	defer srv.Close()
+
+	q := NewQueue("key", WithEndpoints(Endpoints{Queue: srv.URL}), WithRetryPolicy(falclient.NoRetry))
+	if _, err := q.Stream(context.Background(), "fal-ai/flux/dev", "missing"); !errors.Is(err, falclient.ErrNotFound) {
+		t.Errorf("expect not found error, got %v", err)
+	}
+
+	// a consumer which stops reading does not leak the stream
+	ctx, cancel := context.WithCancel(context.Background())
+	ch, err := q.Stream(ctx, "fal-ai/flux/dev", "req-1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	cancel()
+	select {
+	case <-drain(ch):
+	case <-time.After(time.Second):
+		t.Fatal("stream not closed after cancellation")
+	}
+}
+
+func drain[T any](ch <-chan T) <-chan struct{} {
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		for range ch {
+		}
+	}()
+	return done
+}
+
+func TestStreamSeq(t *testing.T) {
+	closed := make(chan struct{})
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/event-stream")
+		writeEvent(w, "1", IN_QUEUE)
+		writeEvent(w, "2", IN_PROGRESS)
+		<-r.Context().Done()
+		close(closed)
+	}))
+	defer srv.Close()
+
+	q := NewQueue("key", WithEndpoints(Endpoints{Queue: srv.URL}), WithRetryPolicy(falclient.NoRetry))
+	for status, err := range q.StreamSeq(context.Background(), "fal-ai/flux/dev", "req-1") {
+		if err != nil {
+			t.Fatal(err)
+		}
+		if status.Status != IN_QUEUE {
+			t.Errorf("unexpected status: %s", status.Status)
+		}
+		break
+	}
+	select {
+	case <-closed:
+	case <-time.After(time.Second):
+		t.Error("response body not closed after break")
+	}
+	for _, err := range q.StreamSeq(context.Background(), "", "req-1") {
+		if err == nil {
+			t.Error("expect invalid endpoint error")
+		}
+	}
+}
@@ -12,7 +12,7 @@ func (q *Queue) Status(ctx context.Context, endpoint string, requestID string) (
 	if err != nil {
 		return nil, err
 	}
-	gw := fmt.Sprintf("%s/%s/requests/%s/status?logs=1", QueueBaseURL, appID.URLString(), requestID)
+	gw := fmt.Sprintf("%s/%s/requests/%s/status?logs=1", q.endpoints.Queue, appID.URLString(), requestID)
 	httpReq, err := http.NewRequestWithContext(ctx, http.MethodGet, gw, nil)
 	if err != nil {
 		return nil, err
@@ -3,19 +3,45 @@ package queue
 import (
 	"context"
 	"fmt"
+	"iter"
 	"net/http"
 )
 
-// Stream Gets the stream status of a request
+// Stream Gets the stream status of a request, the channel is closed after the terminal status
 func (q *Queue) Stream(ctx context.Context, endpoint string, requestID string) (<-chan Status, error) {
-	appID, err := AppIDFromEndpoint(endpoint)
+	httpReq, err := q.streamRequest(ctx, endpoint, requestID)
 	if err != nil {
 		return nil, err
 	}
-	gw := fmt.Sprintf("%s/%s/requests/%s/status/stream?logs=1", QueueBaseURL, appID.URLString(), requestID)
-	httpReq, err := http.NewRequestWithContext(ctx, http.MethodGet, gw, nil)
+	return q.SSE(ctx, httpReq)
+}
+
+// StreamEvents Gets the stream status of a request with the errors ending the stream
+func (q *Queue) StreamEvents(ctx context.Context, endpoint string, requestID string) (<-chan StatusEvent, error) {
+	httpReq, err := q.streamRequest(ctx, endpoint, requestID)
 	if err != nil {
 		return nil, err
 	}
-	return q.SSE(ctx, httpReq)
+	return q.SSEEvents(ctx, httpReq)
+}
+
+// StreamSeq iterates the stream status of a request until the terminal status,
+// e.g. for status, err := range q.StreamSeq(ctx, endpoint, requestID)
+func (q *Queue) StreamSeq(ctx context.Context, endpoint string, requestID string) iter.Seq2[Status, error] {
+	httpReq, err := q.streamRequest(ctx, endpoint, requestID)
+	if err != nil {
+		return func(yield func(Status, error) bool) {
+			yield(Status{}, err)
+		}
+	}
+	return q.SSESeq(ctx, httpReq)
+}
+
+func (q *Queue) streamRequest(ctx context.Context, endpoint string, requestID string) (*http.Request, error) {
+	appID, err := AppIDFromEndpoint(endpoint)
+	if err != nil {
+		return nil, err
+	}
+	gw := fmt.Sprintf("%s/%s/requests/%s/status/stream?logs=1", q.endpoints.Queue, appID.URLString(), requestID)
+	return http.NewRequestWithContext(ctx, http.MethodGet, gw, nil)
 }
@@ -4,8 +4,10 @@ import (
 	"bytes"
 	"context"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"net/http"
+	"net/url"
 	"time"
 )
 
@@ -14,50 +16,139 @@ func (q *Queue) Submit(ctx context.Context, endpoint string, opts ...SubmitOptio
 	for _, opt := range opts {
 		opt(&req)
 	}
-	gw := fmt.Sprintf("%s/%s", QueueBaseURL, endpoint)
+	status, err := q.enqueue(ctx, endpoint, &req)
+	if err != nil {
+		return "", err
+	}
+	requestID := status.RequestID
+	// the result is delivered to the webhook, no need to wait
+	if req.Callback == nil || req.WebhookURL != "" {
+		return requestID, nil
+	}
+	if _, err := q.wait(ctx, endpoint, requestID, &req); err != nil {
+		return requestID, err
+	}
+	return requestID, nil
+}
+
+// enqueue submits the request to the queue
+func (q *Queue) enqueue(ctx context.Context, endpoint string, req *SubmitRequest) (*Status, error) {
+	gw := fmt.Sprintf("%s/%s", q.endpoints.Queue, endpoint)
+	query := make(url.Values, len(req.Query)+1)
+	for k, v := range req.Query {
+		query[k] = append(query[k], v...)
+	}
 	if req.WebhookURL != "" {
-		gw = fmt.Sprintf("%s?logs=1&&fal_webhook=", req.WebhookURL)
+		query.Set("fal_webhook", req.WebhookURL)
+	}
+	if len(query) > 0 {
+		gw = fmt.Sprintf("%s?%s", gw, query.Encode())
+	}
+	input := req.Input
+	if q.transformer != nil {
+		var err error
+		if input, err = q.transformer.TransformInput(ctx, input); err != nil {
+			return nil, fmt.Errorf("transform input: %w", err)
+		}
 	}
 	var buf bytes.Buffer
-	if err := json.NewEncoder(&buf).Encode(req.Input); err != nil {
-		return "", err
+	if err := json.NewEncoder(&buf).Encode(input); err != nil {
+		return nil, err
 	}
 	httpReq, err := http.NewRequestWithContext(ctx, http.MethodPost, gw, &buf)
 	if err != nil {
-		return "", err
+		return nil, err
 	}
 	var resp Status
 	if err := q.fetch(ctx, httpReq, &resp); err != nil {
-		return "", err
+		return nil, err
 	}
-	requestID := resp.RequestID
-	if req.Callback == nil && req.WebhookURL == "" {
-		return requestID, nil
+	return &resp, nil
+}
+
+// wait waits for the completion of the request, returns the last status
+func (q *Queue) wait(ctx context.Context, endpoint string, requestID string, req *SubmitRequest) (*Status, error) {
+	parent := ctx
+	if req.MaxWait > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, req.MaxWait)
+		defer cancel()
 	}
-	if req.Mode == STREAM {
-		ch, err := q.Stream(ctx, endpoint, requestID)
-		if err != nil {
-			return requestID, err
+	if !req.Deadline.IsZero() {
+		if !time.Now().Before(req.Deadline) {
+			return nil, fmt.Errorf("%w: %s", ErrWaitTimeout, requestID)
 		}
-		for ev := range ch {
-			if cb := req.Callback; cb != nil {
-				cb(&ev)
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithDeadline(ctx, req.Deadline)
+		defer cancel()
+	}
+	var (
+		status *Status
+		err    error
+	)
+	if req.Mode == STREAM {
+		status, err = q.waitStream(ctx, endpoint, requestID, req)
+	} else {
+		status, err = q.waitPoll(ctx, endpoint, requestID, req)
+	}
+	if err != nil && ctx.Err() != nil && parent.Err() == nil {
+		err = fmt.Errorf("%w: %s", ErrWaitTimeout, requestID)
+	}
+	return status, err
+}
+
+func (q *Queue) waitStream(ctx context.Context, endpoint string, requestID string, req *SubmitRequest) (*Status, error) {
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	ch, err := q.StreamEvents(ctx, endpoint, requestID)
+	if err != nil {
+		return nil, err
+	}
+	var last *Status
+	for ev := range ch {
+		if ev.Err != nil {
+			if errors.Is(ev.Err, ErrInvalidEvent) {
+				continue
 			}
+			break
 		}
-		return requestID, nil
+		if cb := req.Callback; cb != nil {
+			cb(&ev.Status)
+		}
+		last = &ev.Status
+		if done, err := checkStatus(last); done || err != nil {
+			return last, err
+		}
+	}
+	if err := ctx.Err(); err != nil {
+		return last, err
+	}
+	// the stream may fail before the final status is delivered
+	return q.waitPoll(ctx, endpoint, requestID, req)
+}
+
+func (q *Queue) waitPoll(ctx context.Context, endpoint string, requestID string, req *SubmitRequest) (*Status, error) {
+	interval := req.PollInterval
+	if interval <= 0 {
+		interval = DefaultPollInterval
 	}
 	for {
 		status, err := q.Status(ctx, endpoint, requestID)
 		if err != nil {
-			return requestID, err
+			return nil, err
 		}
 		if cb := req.Callback; cb != nil {
 			cb(status)
 		}
-		if status.Status == COMPLETED {
-			break
+		if done, err := checkStatus(status); done || err != nil {
+			return status, err
+		}
+		timer := time.NewTimer(interval)
+		select {
+		case <-ctx.Done():
+			timer.Stop()
+			return status, ctx.Err()
+		case <-timer.C:
 		}
-		time.Sleep(5 * time.Second)
 	}
-	return requestID, nil
 }
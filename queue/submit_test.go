@@ -4,10 +4,88 @@ import (
 	"context"
 	"encoding/json"
 	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
 	"os"
 	"testing"
+
+	"github.com/bububa/falclient"
+	"github.com/bububa/falclient/storage"
 )
 
+func TestSubmitWebhook(t *testing.T) {
+	const webhookURL = "https://example.com/fal/webhook?source=test&id=1"
+	var calls int
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		calls++
+		if r.Method != http.MethodPost {
+			t.Errorf("expect POST, got %s", r.Method)
+		}
+		if r.URL.Path != "/fal-ai/flux/dev" {
+			t.Errorf("unexpected path: %s", r.URL.Path)
+		}
+		expectQuery := "fal_webhook=" + url.QueryEscape(webhookURL) + "&sync_mode=1"
+		if r.URL.RawQuery != expectQuery {
+			t.Errorf("expect query %s, got %s", expectQuery, r.URL.RawQuery)
+		}
+		if v := r.URL.Query().Get("fal_webhook"); v != webhookURL {
+			t.Errorf("expect webhook %s, got %s", webhookURL, v)
+		}
+		if v := r.Header.Get("Authorization"); v != "Key secret" {
+			t.Errorf("unexpected authorization: %s", v)
+		}
+		if v := r.Header.Get("Content-Type"); v != "application/json" {
+			t.Errorf("unexpected content type: %s", v)
+		}
+		body, _ := io.ReadAll(r.Body)
+		if string(body) != "{\"prompt\":\"cat\"}\n" {
+			t.Errorf("unexpected body: %s", body)
+		}
+		json.NewEncoder(w).Encode(Status{RequestID: "req-1", Status: IN_QUEUE})
+	}))
+	defer srv.Close()
+
+	q := NewQueue("secret", WithEndpoints(Endpoints{Queue: srv.URL}), WithRetryPolicy(falclient.NoRetry))
+	reqID, err := q.Submit(context.Background(), "fal-ai/flux/dev",
+		WithInput(map[string]string{"prompt": "cat"}),
+		WithWebhook(webhookURL),
+		WithQueryParams(url.Values{"sync_mode": {"1"}}),
+		WithCallback(func(*Status) {
+			t.Error("callback should not be called in webhook mode")
+		}),
+	)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if reqID != "req-1" {
+		t.Errorf("expect request id req-1, got %s", reqID)
+	}
+	if calls != 1 {
+		t.Errorf("expect 1 request, got %d", calls)
+	}
+}
+
+func TestSubmitInputTransformer(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := io.ReadAll(r.Body)
+		if string(body) != "{\"image_url\":\"https://cdn/image.png\"}\n" {
+			t.Errorf("unexpected body: %s", body)
+		}
+		json.NewEncoder(w).Encode(Status{RequestID: "req-1", Status: IN_QUEUE})
+	}))
+	defer srv.Close()
+
+	transformer := InputTransformerFunc(func(_ context.Context, input any) (any, error) {
+		return map[string]string{"image_url": "https://cdn/image.png"}, nil
+	})
+	q := NewQueue("secret", WithEndpoints(Endpoints{Queue: srv.URL}), WithRetryPolicy(falclient.NoRetry), WithInputTransformer(transformer))
+	if _, err := q.Submit(context.Background(), "fal-ai/flux/dev", WithInput(map[string][]byte{"image_url": []byte("png")})); err != nil {
+		t.Fatal(err)
+	}
+}
+
 func TestSubmitPoll(t *testing.T) {
 	ctx := context.Background()
 	key := os.Getenv("KEY")
@@ -30,15 +108,10 @@ func TestSubmitPoll(t *testing.T) {
 	}
 	t.Logf("RequestID: %s", reqID)
 	var resp struct {
-		Images []struct {
-			URL         string `json:"url,omitempty"`
-			Width       int    `json:"width,omitempty"`
-			Height      int    `json:"height,omitempty"`
-			ContentType string `json:"content_type,omitempty"`
-		} `json:"images,omitempty"`
-		Seed            int64  `json:"seed,omitempty"`
-		HasNSFWConcepts []bool `json:"has_nsfw_concepts,omitempty"`
-		Prompt          string `json:"prompt,omitempty"`
+		Images          []storage.Image `json:"images,omitempty"`
+		Seed            int64           `json:"seed,omitempty"`
+		HasNSFWConcepts []bool          `json:"has_nsfw_concepts,omitempty"`
+		Prompt          string          `json:"prompt,omitempty"`
 	}
 	if err := queue.Response(ctx, endpoint, reqID, &resp); err != nil {
 		t.Error(err)
@@ -69,15 +142,10 @@ func TestSubmitStream(t *testing.T) {
 		return
 	}
 	var resp struct {
-		Images []struct {
-			URL         string `json:"url,omitempty"`
-			Width       int    `json:"width,omitempty"`
-			Height      int    `json:"height,omitempty"`
-			ContentType string `json:"content_type,omitempty"`
-		} `json:"images,omitempty"`
-		Seed            int64  `json:"seed,omitempty"`
-		HasNSFWConcepts []bool `json:"has_nsfw_concepts,omitempty"`
-		Prompt          string `json:"prompt,omitempty"`
+		Images          []storage.Image `json:"images,omitempty"`
+		Seed            int64           `json:"seed,omitempty"`
+		HasNSFWConcepts []bool          `json:"has_nsfw_concepts,omitempty"`
+		Prompt          string          `json:"prompt,omitempty"`
 	}
 	if err := queue.Response(ctx, endpoint, reqID, &resp); err != nil {
 		t.Error(err)
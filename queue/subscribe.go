@@ -0,0 +1,53 @@
+package queue
+
+import (
+	"context"
+	"errors"
+	"time"
+)
+
+// cancelTimeout timeout of the cancel request sent after the subscribe context is done
+const cancelTimeout = 10 * time.Second
+
+// Subscribe submits the request, waits for its completion and decodes the result into out.
+// The remote request is cancelled when ctx is done before completion
+func (q *Queue) Subscribe(ctx context.Context, endpoint string, input any, out any, opts ...SubmitOption) (*Status, error) {
+	var req SubmitRequest
+	for _, opt := range opts {
+		opt(&req)
+	}
+	req.Input = input
+	status, err := q.enqueue(ctx, endpoint, &req)
+	if err != nil {
+		return nil, err
+	}
+	requestID := status.RequestID
+	last, err := q.wait(ctx, endpoint, requestID, &req)
+	if last != nil {
+		status = last
+	}
+	if err != nil {
+		if ctx.Err() != nil || errors.Is(err, ErrWaitTimeout) {
+			cancelCtx, cancel := context.WithTimeout(context.WithoutCancel(ctx), cancelTimeout)
+			defer cancel()
+			q.Cancel(cancelCtx, endpoint, requestID)
+		}
+		return status, err
+	}
+	if out != nil {
+		if err := q.Response(ctx, endpoint, requestID, out); err != nil {
+			return status, err
+		}
+	}
+	return status, nil
+}
+
+// Subscribe submits the request, waits for its completion and returns the typed result
+func Subscribe[T any](ctx context.Context, q *Queue, endpoint string, input any, opts ...SubmitOption) (*T, *Status, error) {
+	ret := new(T)
+	status, err := q.Subscribe(ctx, endpoint, input, ret, opts...)
+	if err != nil {
+		return nil, status, err
+	}
+	return ret, status, nil
+}
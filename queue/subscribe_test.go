@@ -0,0 +1,151 @@
+package queue
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/bububa/falclient"
+)
+
+func TestSubscribe(t *testing.T) {
+	var polls atomic.Int32
+	mux := http.NewServeMux()
+	mux.HandleFunc("POST /fal-ai/flux/dev", func(w http.ResponseWriter, r *http.Request) {
+		json.NewEncoder(w).Encode(Status{RequestID: "req-1", Status: IN_QUEUE})
+	})
+	mux.HandleFunc("GET /fal-ai/flux/requests/req-1/status", func(w http.ResponseWriter, r *http.Request) {
+		status := IN_PROGRESS
+		if polls.Add(1) > 1 {
+			status = COMPLETED
+		}
+		json.NewEncoder(w).Encode(Status{RequestID: "req-1", Status: status})
+	})
+	mux.HandleFunc("GET /fal-ai/flux/requests/req-1", func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(`{"seed":42}`))
+	})
+	srv := httptest.NewServer(mux)
+	defer srv.Close()
+
+	type result struct {
+		Seed int64 `json:"seed"`
+	}
+	q := NewQueue("key", WithEndpoints(Endpoints{Queue: srv.URL}), WithRetryPolicy(falclient.NoRetry))
+	ret, status, err := Subscribe[result](context.Background(), q, "fal-ai/flux/dev", map[string]string{"prompt": "cat"}, WithPollInterval(time.Millisecond))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if status.Status != COMPLETED {
+		t.Errorf("expect COMPLETED, got %s", status.Status)
+	}
+	if ret.Seed != 42 {
+		t.Errorf("expect seed 42, got %d", ret.Seed)
+	}
+}
+
+func TestSubscribeCancel(t *testing.T) {
+	cancelled := make(chan struct{})
+	mux := http.NewServeMux()
+	mux.HandleFunc("POST /fal-ai/flux/dev", func(w http.ResponseWriter, r *http.Request) {
+		json.NewEncoder(w).Encode(Status{RequestID: "req-1", Status: IN_QUEUE})
+	})
+	mux.HandleFunc("GET /fal-ai/flux/requests/req-1/status", func(w http.ResponseWriter, r *http.Request) {
+		json.NewEncoder(w).Encode(Status{RequestID: "req-1", Status: IN_QUEUE})
+	})
+	mux.HandleFunc("PUT /fal-ai/flux/requests/req-1/cancel", func(w http.ResponseWriter, r *http.Request) {
+		json.NewEncoder(w).Encode(CancelResponse{Status: CANCELLATION_REQUESTED})
+		close(cancelled)
+	})
+	srv := httptest.NewServer(mux)
+	defer srv.Close()
+
+	q := NewQueue("key", WithEndpoints(Endpoints{Queue: srv.URL}), WithRetryPolicy(falclient.NoRetry))
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	_, err := q.Subscribe(ctx, "fal-ai/flux/dev", nil, nil, WithPollInterval(10*time.Millisecond))
+	if !errors.Is(err, context.DeadlineExceeded) {
+		t.Errorf("expect deadline exceeded, got %v", err)
+	}
+	select {
+	case <-cancelled:
+	case <-time.After(time.Second):
+		t.Error("remote request not cancelled")
+	}
+}
+
+func TestSubscribeFailure(t *testing.T) {
+	tests := []struct {
+		name   string
+		status Status
+		target error
+	}{
+		{name: "completed with error", status: Status{Status: COMPLETED, Error: "out of memory", ErrorType: "runner_error"}, target: ErrJobFailed},
+		{name: "failed", status: Status{Status: FAILED}, target: ErrJobFailed},
+		{name: "unknown", status: Status{Status: "EXPLODED"}, target: ErrUnknownStatus},
+		{name: "max wait", status: Status{Status: IN_PROGRESS}, target: ErrWaitTimeout},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			mux := http.NewServeMux()
+			mux.HandleFunc("POST /fal-ai/flux/dev", func(w http.ResponseWriter, r *http.Request) {
+				json.NewEncoder(w).Encode(Status{RequestID: "req-1", Status: IN_QUEUE})
+			})
+			mux.HandleFunc("GET /fal-ai/flux/requests/req-1/status", func(w http.ResponseWriter, r *http.Request) {
+				status := tt.status
+				status.RequestID = "req-1"
+				json.NewEncoder(w).Encode(status)
+			})
+			mux.HandleFunc("PUT /fal-ai/flux/requests/req-1/cancel", func(w http.ResponseWriter, r *http.Request) {
+				json.NewEncoder(w).Encode(CancelResponse{Status: CANCELLATION_REQUESTED})
+			})
+			srv := httptest.NewServer(mux)
+			defer srv.Close()
+
+			q := NewQueue("key", WithEndpoints(Endpoints{Queue: srv.URL}), WithRetryPolicy(falclient.NoRetry))
+			_, err := q.Subscribe(context.Background(), "fal-ai/flux/dev", nil, nil, WithPollInterval(10*time.Millisecond), WithMaxWait(50*time.Millisecond))
+			if !errors.Is(err, tt.target) {
+				t.Fatalf("expect %v, got %v", tt.target, err)
+			}
+			var jobErr *JobError
+			if errors.As(err, &jobErr) && jobErr.Message != tt.status.Error {
+				t.Errorf("expect message %q, got %q", tt.status.Error, jobErr.Message)
+			}
+		})
+	}
+}
+
+func TestSubscribeDeadline(t *testing.T) {
+	var polls atomic.Int32
+	mux := http.NewServeMux()
+	mux.HandleFunc("POST /fal-ai/flux/dev", func(w http.ResponseWriter, r *http.Request) {
+		json.NewEncoder(w).Encode(Status{RequestID: "req-1", Status: IN_QUEUE})
+	})
+	mux.HandleFunc("GET /fal-ai/flux/requests/req-1/status", func(w http.ResponseWriter, r *http.Request) {
+		polls.Add(1)
+		json.NewEncoder(w).Encode(Status{RequestID: "req-1", Status: IN_PROGRESS})
+	})
+	mux.HandleFunc("PUT /fal-ai/flux/requests/req-1/cancel", func(w http.ResponseWriter, r *http.Request) {
+		json.NewEncoder(w).Encode(CancelResponse{Status: CANCELLATION_REQUESTED})
+	})
+	srv := httptest.NewServer(mux)
+	defer srv.Close()
+
+	q := NewQueue("key", WithEndpoints(Endpoints{Queue: srv.URL}), WithRetryPolicy(falclient.NoRetry))
+	// a deadline already passed times out without waiting
+	_, err := q.Subscribe(context.Background(), "fal-ai/flux/dev", nil, nil, WithPollInterval(10*time.Millisecond), WithDeadline(time.Now().Add(-time.Second)))
+	if !errors.Is(err, ErrWaitTimeout) {
+		t.Fatalf("expect wait timeout, got %v", err)
+	}
+	if n := polls.Load(); n != 0 {
+		t.Errorf("expect no poll, got %d", n)
+	}
+	_, err = q.Subscribe(context.Background(), "fal-ai/flux/dev", nil, nil, WithPollInterval(10*time.Millisecond), WithDeadline(time.Now().Add(50*time.Millisecond)))
+	if !errors.Is(err, ErrWaitTimeout) {
+		t.Fatalf("expect wait timeout, got %v", err)
+	}
+}
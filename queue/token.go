@@ -0,0 +1,218 @@
+package queue
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/bububa/falclient"
+	"github.com/bububa/falclient/internal/flight"
+)
+
+// ErrRealtimeTokenFailed the realtime token could not be fetched
+var ErrRealtimeTokenFailed = errors.New("fetch realtime token failed")
+
+const (
+	// DefaultRealtimeTokenExpiration default lifetime of a realtime token
+	DefaultRealtimeTokenExpiration = 2 * time.Minute
+	// DefaultRealtimeTokenRefreshSkew default duration before expiration a realtime token is refreshed
+	DefaultRealtimeTokenRefreshSkew = 30 * time.Second
+	// DefaultRealtimeTokenRefreshTimeout default max duration of a token request shared by concurrent callers
+	DefaultRealtimeTokenRefreshTimeout = 30 * time.Second
+	// realtimeTokenParam query parameter carrying the token of a websocket connection
+	realtimeTokenParam = "fal_jwt_token"
+)
+
+// RealtimeToken short-lived jwt authorizing connections to a set of apps,
+// it can be handed to untrusted clients, e.g. browsers, in place of the api key
+type RealtimeToken struct {
+	Token    string    `json:"token"`
+	ExpireAt time.Time `json:"expires_at"`
+}
+
+// Expired reports whether the token is expired
+func (t RealtimeToken) Expired() bool {
+	return !t.ExpireAt.After(time.Now())
+}
+
+// realtimeTokenRequest body of the token api
+type realtimeTokenRequest struct {
+	AllowedApps     []string `json:"allowed_apps"`
+	TokenExpiration int64    `json:"token_expiration"`
+}
+
+// RealtimeTokenManager fetches, caches and refreshes app scoped realtime tokens, safe for concurrent use
+type RealtimeTokenManager struct {
+	http       *http.Client
+	retry      falclient.RetryPolicy
+	key        string
+	endpoints  Endpoints
+	expiration time.Duration
+	skew       time.Duration
+	timeout    time.Duration
+	tokens     map[string]RealtimeToken
+	inflight   flight.Group[string, RealtimeToken]
+	lock       sync.Mutex
+}
+
+func NewRealtimeTokenManager(key string) *RealtimeTokenManager {
+	return &RealtimeTokenManager{
+		key:        key,
+		http:       http.DefaultClient,
+		retry:      falclient.DefaultRetryPolicy,
+		endpoints:  DefaultEndpoints(),
+		expiration: DefaultRealtimeTokenExpiration,
+		skew:       DefaultRealtimeTokenRefreshSkew,
+		timeout:    DefaultRealtimeTokenRefreshTimeout,
+		tokens:     make(map[string]RealtimeToken),
+	}
+}
+
+func (m *RealtimeTokenManager) SetHTTPClient(clt *http.Client) {
+	m.http = clt
+}
+
+// SetRetryPolicy sets the retry policy of token requests
+func (m *RealtimeTokenManager) SetRetryPolicy(p falclient.RetryPolicy) {
+	m.retry = p
+}
+
+// SetEndpoints overrides the fal.ai endpoints, empty fields fallback to defaults
+func (m *RealtimeTokenManager) SetEndpoints(v Endpoints) {
+	m.endpoints = v.withDefaults()
+}
+
+// SetExpiration sets the lifetime of the fetched tokens, default DefaultRealtimeTokenExpiration
+func (m *RealtimeTokenManager) SetExpiration(d time.Duration) {
+	m.expiration = max(d, time.Second)
+}
+
+// SetRefreshSkew sets the duration before expiration a token is refreshed, default DefaultRealtimeTokenRefreshSkew.
+// The skew is capped to half of the token lifetime
+func (m *RealtimeTokenManager) SetRefreshSkew(d time.Duration) {
+	m.skew = max(d, 0)
+}
+
+// SetRefreshTimeout bounds a token request, default DefaultRealtimeTokenRefreshTimeout.
+// The request outlives the caller which started it and would otherwise block the later callers sharing it
+func (m *RealtimeTokenManager) SetRefreshTimeout(d time.Duration) {
+	if d > 0 {
+		m.timeout = d
+	}
+}
+
+// Token returns a token allowed to connect to the apps, e.g. "fal-ai/fast-lcm-diffusion".
+// Tokens are cached per set of apps and refreshed when missing, invalidated or about to expire
+func (m *RealtimeTokenManager) Token(ctx context.Context, apps ...string) (RealtimeToken, error) {
+	aliases, err := appAliases(apps)
+	if err != nil {
+		return RealtimeToken{}, err
+	}
+	key := strings.Join(aliases, ",")
+	m.lock.Lock()
+	token, ok := m.tokens[key]
+	m.lock.Unlock()
+	if ok && !m.stale(token) {
+		return token, nil
+	}
+	return m.refresh(ctx, key, aliases)
+}
+
+// Refresh fetches a new token allowed to connect to the apps, concurrent calls for the same apps share a single request
+func (m *RealtimeTokenManager) Refresh(ctx context.Context, apps ...string) (RealtimeToken, error) {
+	aliases, err := appAliases(apps)
+	if err != nil {
+		return RealtimeToken{}, err
+	}
+	return m.refresh(ctx, strings.Join(aliases, ","), aliases)
+}
+
+// Invalidate drops the cached token of the apps, e.g. after it was rejected, the next Token call refreshes it
+func (m *RealtimeTokenManager) Invalidate(apps ...string) {
+	aliases, err := appAliases(apps)
+	if err != nil {
+		return
+	}
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	delete(m.tokens, strings.Join(aliases, ","))
+}
+
+// refresh fetches the token of the apps, one request per set of apps is in flight
+func (m *RealtimeTokenManager) refresh(ctx context.Context, key string, aliases []string) (RealtimeToken, error) {
+	return m.inflight.Do(ctx, key, m.timeout, func(ctx context.Context) (RealtimeToken, error) {
+		token, err := m.fetch(ctx, aliases)
+		if err != nil {
+			return token, err
+		}
+		m.lock.Lock()
+		m.tokens[key] = token
+		m.lock.Unlock()
+		return token, nil
+	})
+}
+
+func (m *RealtimeTokenManager) fetch(ctx context.Context, aliases []string) (RealtimeToken, error) {
+	body, err := json.Marshal(realtimeTokenRequest{
+		AllowedApps:     aliases,
+		TokenExpiration: int64(m.expiration / time.Second),
+	})
+	if err != nil {
+		return RealtimeToken{}, err
+	}
+	httpReq, err := http.NewRequestWithContext(ctx, http.MethodPost, m.endpoints.TokenURL(), bytes.NewReader(body))
+	if err != nil {
+		return RealtimeToken{}, errors.Join(ErrRealtimeTokenFailed, err)
+	}
+	httpReq.Header.Set("Authorization", fmt.Sprintf("Key %s", m.key))
+	httpReq.Header.Set("Accept", "application/json")
+	httpReq.Header.Set("Content-Type", "application/json")
+	// minting a token has no side effect, it is retried as an idempotent request
+	httpReq.Header["Idempotency-Key"] = nil
+	// the lifetime counts from the request, not the response
+	expireAt := time.Now().Add(m.expiration)
+	httpResp, err := falclient.Do(ctx, m.http, httpReq, m.retry)
+	if err != nil {
+		return RealtimeToken{}, errors.Join(ErrRealtimeTokenFailed, err)
+	}
+	defer httpResp.Body.Close()
+	if !falclient.IsSuccess(httpResp.StatusCode) {
+		return RealtimeToken{}, errors.Join(ErrRealtimeTokenFailed, falclient.NewAPIError(httpResp))
+	}
+	// the api responds with the token as a json string
+	var token string
+	if err := json.NewDecoder(httpResp.Body).Decode(&token); err != nil {
+		return RealtimeToken{}, errors.Join(ErrRealtimeTokenFailed, err)
+	}
+	return RealtimeToken{Token: token, ExpireAt: expireAt}, nil
+}
+
+// stale reports whether the token expires within the refresh skew
+func (m *RealtimeTokenManager) stale(token RealtimeToken) bool {
+	skew := min(m.skew, m.expiration/2)
+	return time.Now().Add(skew).After(token.ExpireAt)
+}
+
+// appAliases returns the sorted unique aliases of the apps, tokens are scoped by app alias
+func appAliases(apps []string) ([]string, error) {
+	if len(apps) == 0 {
+		return nil, errors.New("realtime token requires at least one app")
+	}
+	ret := make([]string, 0, len(apps))
+	for _, app := range apps {
+		appID, err := AppIDFromEndpoint(app)
+		if err != nil {
+			return nil, err
+		}
+		ret = append(ret, appID.Alias)
+	}
+	slices.Sort(ret)
+	return slices.Compact(ret), nil
+}
@@ -0,0 +1,139 @@
+package queue
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/bububa/falclient"
+	"github.com/coder/websocket"
+	"github.com/coder/websocket/wsjson"
+)
+
+func TestRealtimeTokens(t *testing.T) {
+	var (
+		issued  []string
+		revoked = make(map[string]bool)
+		lock    sync.Mutex
+	)
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/tokens/" {
+			if r.Header.Get("Authorization") != "Key key" {
+				t.Errorf("unexpected authorization: %s", r.Header.Get("Authorization"))
+			}
+			var req realtimeTokenRequest
+			if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+				t.Error(err)
+			}
+			if len(req.AllowedApps) != 1 || req.AllowedApps[0] != "fast-lcm" || req.TokenExpiration != 120 {
+				t.Errorf("unexpected token request: %+v", req)
+			}
+			lock.Lock()
+			token := fmt.Sprintf("jwt-%d", len(issued)+1)
+			issued = append(issued, token)
+			lock.Unlock()
+			json.NewEncoder(w).Encode(token)
+			return
+		}
+		token := r.URL.Query().Get("fal_jwt_token")
+		lock.Lock()
+		rejected := token == "" || revoked[token]
+		lock.Unlock()
+		if rejected || r.Header.Get("Authorization") != "" {
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+		conn, err := websocket.Accept(w, r, nil)
+		if err != nil {
+			t.Error(err)
+			return
+		}
+		defer conn.CloseNow()
+		var input map[string]string
+		if err := wsjson.Read(r.Context(), conn, &input); err != nil {
+			return
+		}
+		wsjson.Write(r.Context(), conn, WebsocketEvent{Type: WSEnd, RequestID: token})
+		conn.Close(websocket.StatusNormalClosure, "")
+	}))
+	defer srv.Close()
+
+	endpoints := Endpoints{WS: srv.URL, Rest: srv.URL}
+	tokens := NewRealtimeTokenManager("key")
+	tokens.SetEndpoints(endpoints)
+	q := NewQueue("key", WithEndpoints(endpoints), WithRealtimeTokens(tokens))
+	ctx := context.Background()
+
+	// the token handed to a frontend is reused by the connections to the same app
+	token, err := q.RealtimeTokens().Token(ctx, "fal-ai/fast-lcm")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if token.Token != "jwt-1" || token.Expired() {
+		t.Fatalf("unexpected token: %+v", token)
+	}
+	realtime := func() string {
+		for ev, err := range q.RealtimeSeq(ctx, "fal-ai/fast-lcm", map[string]string{"prompt": "cat"}) {
+			if err != nil {
+				t.Fatal(err)
+			}
+			return ev.RequestID
+		}
+		return ""
+	}
+	if got := realtime(); got != "jwt-1" {
+		t.Errorf("expect connection with jwt-1, got %s", got)
+	}
+	// a rejected token is refreshed once
+	lock.Lock()
+	revoked["jwt-1"] = true
+	lock.Unlock()
+	if got := realtime(); got != "jwt-2" {
+		t.Errorf("expect connection with jwt-2, got %s", got)
+	}
+	if len(issued) != 2 {
+		t.Errorf("expect 2 issued tokens, got %d", len(issued))
+	}
+}
+
+func TestRealtimeTokenTimeout(t *testing.T) {
+	var calls atomic.Int32
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		// the first request never gets an answer
+		if calls.Add(1) == 1 {
+			io.Copy(io.Discard, r.Body)
+			<-r.Context().Done()
+			return
+		}
+		json.NewEncoder(w).Encode("jwt")
+	}))
+	defer srv.Close()
+	tokens := NewRealtimeTokenManager("key")
+	tokens.SetEndpoints(Endpoints{Rest: srv.URL})
+	tokens.SetRetryPolicy(falclient.NoRetry)
+	tokens.SetRefreshTimeout(50 * time.Millisecond)
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+	if _, err := tokens.Token(ctx, "fal-ai/fast-lcm"); !errors.Is(err, context.DeadlineExceeded) {
+		t.Fatalf("expect deadline exceeded, got %v", err)
+	}
+	// the hung request ends with its own timeout instead of blocking the later callers
+	time.Sleep(100 * time.Millisecond)
+	ctx, cancel = context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+	token, err := tokens.Token(ctx, "fal-ai/fast-lcm")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if token.Token != "jwt" {
+		t.Errorf("unexpected token: %s", token.Token)
+	}
+}
@@ -2,6 +2,8 @@ package queue
 
 import (
 	"encoding/json"
+	"net/url"
+	"time"
 )
 
 type Status struct {
@@ -13,6 +15,19 @@ type Status struct {
 	QueuePosition int        `json:"queue_position,omitempty"`
 	Logs          []Log      `json:"logs,omitempty"`
 	Metrics       *Metrics   `json:"metrics,omitempty"`
+	// Error error message of a failed request
+	Error string `json:"error,omitempty"`
+	// ErrorType error type of a failed request
+	ErrorType string `json:"error_type,omitempty"`
+}
+
+// Failed reports whether the request finished with an error
+func (s Status) Failed() bool {
+	switch s.Status {
+	case FAILED, CANCELLED:
+		return true
+	}
+	return s.Status.IsTerminal() && s.Error != ""
 }
 
 type StatusType string
@@ -23,8 +38,19 @@ const (
 	COMPLETED              StatusType = "COMPLETED"
 	CANCELLATION_REQUESTED StatusType = "CANCELLATION_REQUESTED"
 	ALREADY_COMPLETED      StatusType = "ALREADY_COMPLETED"
+	FAILED                 StatusType = "FAILED"
+	CANCELLED              StatusType = "CANCELLED"
 )
 
+// IsTerminal reports whether the request will not change its status anymore
+func (s StatusType) IsTerminal() bool {
+	switch s {
+	case COMPLETED, ALREADY_COMPLETED, FAILED, CANCELLED:
+		return true
+	}
+	return false
+}
+
 type LogLevel string
 
 const (
@@ -60,11 +86,18 @@ const (
 	STREAM
 )
 
+// DefaultPollInterval default interval between status polls
+const DefaultPollInterval = 5 * time.Second
+
 type SubmitRequest struct {
-	Mode       QueueMode `json:"mode,omitempty"`
-	Input      any       `json:"input,omitempty"`
-	Callback   Callback  `json:"-"`
-	WebhookURL string    `json:"-"`
+	Mode         QueueMode     `json:"mode,omitempty"`
+	Input        any           `json:"input,omitempty"`
+	Callback     Callback      `json:"-"`
+	WebhookURL   string        `json:"-"`
+	PollInterval time.Duration `json:"-"`
+	MaxWait      time.Duration `json:"-"`
+	Deadline     time.Time     `json:"-"`
+	Query        url.Values    `json:"-"`
 }
 
 type SubmitOption func(*SubmitRequest)
@@ -81,18 +114,52 @@ func WithCallback(cb Callback) SubmitOption {
 	}
 }
 
+// WithWebhook delivers the result to the webhook url, Submit returns right after the request is enqueued
 func WithWebhook(webhookURL string) SubmitOption {
 	return func(r *SubmitRequest) {
 		r.WebhookURL = webhookURL
 	}
 }
 
+// WithQueryParams adds extra query parameters to the submit url
+func WithQueryParams(v url.Values) SubmitOption {
+	return func(r *SubmitRequest) {
+		if r.Query == nil {
+			r.Query = make(url.Values, len(v))
+		}
+		for k, vs := range v {
+			r.Query[k] = append(r.Query[k], vs...)
+		}
+	}
+}
+
 func WithMode(mode QueueMode) SubmitOption {
 	return func(r *SubmitRequest) {
 		r.Mode = mode
 	}
 }
 
+// WithMaxWait sets the max duration to wait for the request to finish
+func WithMaxWait(d time.Duration) SubmitOption {
+	return func(r *SubmitRequest) {
+		r.MaxWait = d
+	}
+}
+
+// WithDeadline sets the deadline for the request to finish
+func WithDeadline(t time.Time) SubmitOption {
+	return func(r *SubmitRequest) {
+		r.Deadline = t
+	}
+}
+
+// WithPollInterval sets the interval between status polls, default DefaultPollInterval
+func WithPollInterval(d time.Duration) SubmitOption {
+	return func(r *SubmitRequest) {
+		r.PollInterval = d
+	}
+}
+
 type WebsocketEventType string
 
 const (
@@ -107,6 +174,24 @@ type WebsocketEvent struct {
 	Status                 int                `json:"status,omitempty"`
 	Headers                map[string]string  `json:"headers,omitempty"`
 	TimeToFirstByteSeconds float64            `json:"time_to_first_byte_seconds,omitempty"`
-	Data                   json.RawMessage    `json:"data,omitempty"`
-	Err                    error              `json:"err,omitempty"`
+	// Error message of a WSError event sent by the server
+	Error string `json:"error,omitempty"`
+	// Reason cause of a WSError event sent by the server
+	Reason string `json:"reason,omitempty"`
+	// Data result of a json event
+	Data json.RawMessage `json:"data,omitempty"`
+	// Payload result encoded with the codec of the received frame, decode it with Decode
+	Payload []byte `json:"-"`
+	// Err local read or decode failure of an event without type, not sent on the wire.
+	// Errors reported by the server are WSError events with Error and Reason set
+	Err   error         `json:"-"`
+	codec RealtimeCodec `json:"-"`
+}
+
+// Decode decodes the result of the event into v with the codec it was received with
+func (e WebsocketEvent) Decode(v any) error {
+	if e.codec == nil {
+		return json.Unmarshal(e.Data, v)
+	}
+	return e.codec.Unmarshal(e.Payload, v)
 }
@@ -0,0 +1,178 @@
+package falclient
+
+import (
+	"context"
+	"errors"
+	"io"
+	"math"
+	"math/rand/v2"
+	"net"
+	"net/http"
+	"strconv"
+	"time"
+)
+
+// RetryPolicy decides whether a failed request should be retried
+type RetryPolicy interface {
+	// Backoff returns the delay before the next attempt and whether the request should be retried.
+	// attempt is the number of attempts already made, resp is nil when err is not nil
+	Backoff(attempt int, req *http.Request, resp *http.Response, err error) (time.Duration, bool)
+}
+
+var (
+	// DefaultRetryPolicy retries transient failures up to 3 attempts
+	DefaultRetryPolicy RetryPolicy = &BackoffPolicy{
+		MaxAttempts: 3,
+		BaseDelay:   500 * time.Millisecond,
+		MaxDelay:    10 * time.Second,
+		Jitter:      0.2,
+	}
+	// NoRetry never retries
+	NoRetry RetryPolicy = noRetry{}
+)
+
+type noRetry struct{}
+
+func (noRetry) Backoff(int, *http.Request, *http.Response, error) (time.Duration, bool) {
+	return 0, false
+}
+
+// BackoffPolicy exponential backoff retry policy honoring Retry-After
+type BackoffPolicy struct {
+	// MaxAttempts max attempts including the first one
+	MaxAttempts int
+	// BaseDelay delay before the second attempt, doubled on each further attempt
+	BaseDelay time.Duration
+	// MaxDelay upper bound of the computed backoff delay and of the Retry-After delay
+	MaxDelay time.Duration
+	// Jitter random factor in [0, 1] applied to the computed delay
+	Jitter float64
+	// Idempotent classifies requests, default IsIdempotent
+	Idempotent func(*http.Request) bool
+}
+
+func (p *BackoffPolicy) Backoff(attempt int, req *http.Request, resp *http.Response, err error) (time.Duration, bool) {
+	if attempt >= p.MaxAttempts {
+		return 0, false
+	}
+	idempotent := IsIdempotent
+	if p.Idempotent != nil {
+		idempotent = p.Idempotent
+	}
+	if err != nil {
+		if errors.Is(err, context.Canceled) || errors.Is(err, context.DeadlineExceeded) {
+			return 0, false
+		}
+		if !idempotent(req) && !isDialError(err) {
+			return 0, false
+		}
+		return p.delay(attempt), true
+	}
+	if resp == nil || !IsRetryableStatus(resp.StatusCode) {
+		return 0, false
+	}
+	if !idempotent(req) {
+		// the request was not processed by the server only in these cases
+		switch resp.StatusCode {
+		case http.StatusTooManyRequests, http.StatusServiceUnavailable:
+		default:
+			return 0, false
+		}
+	}
+	if d, ok := RetryAfter(resp); ok {
+		if p.MaxDelay > 0 {
+			d = min(d, p.MaxDelay)
+		}
+		return d, true
+	}
+	return p.delay(attempt), true
+}
+
+func (p *BackoffPolicy) delay(attempt int) time.Duration {
+	d := float64(p.BaseDelay) * math.Pow(2, float64(attempt-1))
+	if p.MaxDelay > 0 && d > float64(p.MaxDelay) {
+		d = float64(p.MaxDelay)
+	}
+	if p.Jitter > 0 {
+		d += d * p.Jitter * (rand.Float64()*2 - 1)
+	}
+	return time.Duration(d)
+}
+
+// IsIdempotent reports whether the request can be safely sent more than once.
+// As in net/http, a request with an Idempotency-Key or X-Idempotency-Key header is idempotent,
+// a nil header value marks the request without sending the header
+func IsIdempotent(req *http.Request) bool {
+	if _, ok := req.Header["Idempotency-Key"]; ok {
+		return true
+	}
+	if _, ok := req.Header["X-Idempotency-Key"]; ok {
+		return true
+	}
+	switch req.Method {
+	case http.MethodGet, http.MethodHead, http.MethodOptions, http.MethodTrace, http.MethodPut, http.MethodDelete:
+		return true
+	}
+	return false
+}
+
+func isDialError(err error) bool {
+	var opErr *net.OpError
+	return errors.As(err, &opErr) && opErr.Op == "dial"
+}
+
+// RetryAfter parses the Retry-After response header
+func RetryAfter(resp *http.Response) (time.Duration, bool) {
+	v := resp.Header.Get("Retry-After")
+	if v == "" {
+		return 0, false
+	}
+	if secs, err := strconv.Atoi(v); err == nil && secs >= 0 {
+		return time.Duration(secs) * time.Second, true
+	}
+	if t, err := http.ParseTime(v); err == nil {
+		return max(time.Until(t), 0), true
+	}
+	return 0, false
+}
+
+// Do sends the request and retries it according to the policy.
+// A request with a body is only retried when req.GetBody is set
+func Do(ctx context.Context, clt *http.Client, req *http.Request, policy RetryPolicy) (*http.Response, error) {
+	if policy == nil {
+		policy = NoRetry
+	}
+	for attempt := 1; ; attempt++ {
+		httpReq := req
+		if attempt > 1 {
+			httpReq = req.Clone(ctx)
+			if req.Body != nil && req.Body != http.NoBody {
+				body, err := req.GetBody()
+				if err != nil {
+					return nil, err
+				}
+				httpReq.Body = body
+			}
+		}
+		resp, err := clt.Do(httpReq)
+		if err == nil && IsSuccess(resp.StatusCode) {
+			return resp, nil
+		}
+		rewindable := req.Body == nil || req.Body == http.NoBody || req.GetBody != nil
+		delay, retry := policy.Backoff(attempt, req, resp, err)
+		if !retry || !rewindable {
+			return resp, err
+		}
+		if resp != nil {
+			io.Copy(io.Discard, io.LimitReader(resp.Body, 4096))
+			resp.Body.Close()
+		}
+		timer := time.NewTimer(delay)
+		select {
+		case <-ctx.Done():
+			timer.Stop()
+			return nil, ctx.Err()
+		case <-timer.C:
+		}
+	}
+}
@@ -0,0 +1,71 @@
+package falclient
+
+import (
+	"context"
+	"io"
+	"maps"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestDo(t *testing.T) {
+	policy := &BackoffPolicy{MaxAttempts: 3, BaseDelay: time.Millisecond}
+	tests := []struct {
+		name     string
+		method   string
+		header   http.Header
+		codes    []int
+		attempts int32
+		code     int
+	}{
+		{name: "get retried", method: http.MethodGet, codes: []int{http.StatusBadGateway, http.StatusServiceUnavailable, http.StatusOK}, attempts: 3, code: http.StatusOK},
+		{name: "post not retried on bad gateway", method: http.MethodPost, codes: []int{http.StatusBadGateway, http.StatusOK}, attempts: 1, code: http.StatusBadGateway},
+		{name: "post with idempotency key retried", method: http.MethodPost, header: http.Header{"Idempotency-Key": nil}, codes: []int{http.StatusBadGateway, http.StatusOK}, attempts: 2, code: http.StatusOK},
+		{name: "post retried on rate limit", method: http.MethodPost, codes: []int{http.StatusTooManyRequests, http.StatusOK}, attempts: 2, code: http.StatusOK},
+		{name: "max attempts", method: http.MethodPut, codes: []int{http.StatusInternalServerError, http.StatusInternalServerError, http.StatusInternalServerError, http.StatusOK}, attempts: 3, code: http.StatusInternalServerError},
+		{name: "not retryable", method: http.MethodGet, codes: []int{http.StatusBadRequest, http.StatusOK}, attempts: 1, code: http.StatusBadRequest},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var attempts atomic.Int32
+			srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				n := attempts.Add(1)
+				if body, _ := io.ReadAll(r.Body); string(body) != "{}" {
+					t.Errorf("attempt %d: unexpected body %q", n, body)
+				}
+				if tt.codes[n-1] == http.StatusTooManyRequests {
+					w.Header().Set("Retry-After", "0")
+				}
+				w.WriteHeader(tt.codes[n-1])
+			}))
+			defer srv.Close()
+			ctx := context.Background()
+			req, _ := http.NewRequestWithContext(ctx, tt.method, srv.URL, strings.NewReader("{}"))
+			maps.Copy(req.Header, tt.header)
+			resp, err := Do(ctx, srv.Client(), req, policy)
+			if err != nil {
+				t.Fatal(err)
+			}
+			resp.Body.Close()
+			if resp.StatusCode != tt.code {
+				t.Errorf("expect status %d, got %d", tt.code, resp.StatusCode)
+			}
+			if got := attempts.Load(); got != tt.attempts {
+				t.Errorf("expect %d attempts, got %d", tt.attempts, got)
+			}
+		})
+	}
+}
+
+func TestRetryAfterCapped(t *testing.T) {
+	policy := &BackoffPolicy{MaxAttempts: 3, BaseDelay: time.Millisecond, MaxDelay: time.Second}
+	req, _ := http.NewRequest(http.MethodGet, "http://localhost", nil)
+	resp := &http.Response{StatusCode: http.StatusServiceUnavailable, Header: http.Header{"Retry-After": []string{"86400"}}}
+	if d, ok := policy.Backoff(1, req, resp, nil); !ok || d != time.Second {
+		t.Errorf("expect retry after %s, got %s %v", time.Second, d, ok)
+	}
+}
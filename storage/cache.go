@@ -0,0 +1,246 @@
+package storage
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"hash"
+	"io"
+	"os"
+	"sync"
+	"time"
+)
+
+// ErrCacheMiss the content is not cached or its access url expired
+var ErrCacheMiss = errors.New("upload cache miss")
+
+// DefaultUploadCacheTTL default duration an access url is reused
+const DefaultUploadCacheTTL = 24 * time.Hour
+
+// UploadCache caches the access urls of uploaded contents by the hex encoded sha256 of the content
+type UploadCache interface {
+	// Get returns the access url of the content, ErrCacheMiss if not cached or expired
+	Get(ctx context.Context, hash string) (string, error)
+	// Set caches the access url of the content until ttl elapses
+	Set(ctx context.Context, hash string, accessURL string, ttl time.Duration) error
+}
+
+// CacheErrorFunc handles a failed upload cache read or write
+type CacheErrorFunc func(ctx context.Context, err error)
+
+// ignoreCacheError default CacheErrorFunc, cache failures are only reported to a handler set with WithCacheErrorHandler
+func ignoreCacheError(context.Context, error) {}
+
+// cacheEntry cached access url
+type cacheEntry struct {
+	URL      string    `json:"url"`
+	ExpireAt time.Time `json:"expire_at"`
+}
+
+// MemoryUploadCache in-memory UploadCache
+type MemoryUploadCache struct {
+	items map[string]cacheEntry
+	lock  sync.RWMutex
+}
+
+func NewMemoryUploadCache() *MemoryUploadCache {
+	return &MemoryUploadCache{
+		items: make(map[string]cacheEntry),
+	}
+}
+
+func (c *MemoryUploadCache) Get(_ context.Context, hash string) (string, error) {
+	c.lock.RLock()
+	defer c.lock.RUnlock()
+	entry, ok := c.items[hash]
+	if !ok || !entry.ExpireAt.After(time.Now()) {
+		return "", ErrCacheMiss
+	}
+	return entry.URL, nil
+}
+
+func (c *MemoryUploadCache) Set(_ context.Context, hash string, accessURL string, ttl time.Duration) error {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	now := time.Now()
+	for k, entry := range c.items {
+		if !entry.ExpireAt.After(now) {
+			delete(c.items, k)
+		}
+	}
+	c.items[hash] = cacheEntry{URL: accessURL, ExpireAt: now.Add(ttl)}
+	return nil
+}
+
+// FileUploadCache UploadCache persisted as a json file
+type FileUploadCache struct {
+	path  string
+	items map[string]cacheEntry
+	lock  sync.RWMutex
+}
+
+// NewFileUploadCache opens the cache at path, the file is created on first write
+func NewFileUploadCache(path string) (*FileUploadCache, error) {
+	ret := &FileUploadCache{
+		path:  path,
+		items: make(map[string]cacheEntry),
+	}
+	bs, err := os.ReadFile(path)
+	if err != nil {
+		if errors.Is(err, os.ErrNotExist) {
+			return ret, nil
+		}
+		return nil, err
+	}
+	if len(bs) > 0 {
+		if err := json.Unmarshal(bs, &ret.items); err != nil {
+			return nil, err
+		}
+	}
+	return ret, nil
+}
+
+func (c *FileUploadCache) Get(_ context.Context, hash string) (string, error) {
+	c.lock.RLock()
+	defer c.lock.RUnlock()
+	entry, ok := c.items[hash]
+	if !ok || !entry.ExpireAt.After(time.Now()) {
+		return "", ErrCacheMiss
+	}
+	return entry.URL, nil
+}
+
+func (c *FileUploadCache) Set(_ context.Context, hash string, accessURL string, ttl time.Duration) error {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	now := time.Now()
+	for k, entry := range c.items {
+		if !entry.ExpireAt.After(now) {
+			delete(c.items, k)
+		}
+	}
+	c.items[hash] = cacheEntry{URL: accessURL, ExpireAt: now.Add(ttl)}
+	bs, err := json.Marshal(c.items)
+	if err != nil {
+		return err
+	}
+	return writeFileAtomic(c.path, bs)
+}
+
+// KVUploadCache UploadCache backed by a KV, e.g. a BoltKV
+type KVUploadCache struct {
+	kv     KV
+	prefix string
+}
+
+// NewKVUploadCache creates a KVUploadCache storing the access urls under prefix+hash keys
+func NewKVUploadCache(kv KV, prefix string) *KVUploadCache {
+	return &KVUploadCache{kv: kv, prefix: prefix}
+}
+
+func (c *KVUploadCache) Get(ctx context.Context, hash string) (string, error) {
+	v, err := c.kv.Get(ctx, c.prefix+hash)
+	if err != nil {
+		if errors.Is(err, ErrKeyNotFound) {
+			return "", ErrCacheMiss
+		}
+		return "", err
+	}
+	return string(v), nil
+}
+
+func (c *KVUploadCache) Set(ctx context.Context, hash string, accessURL string, ttl time.Duration) error {
+	return c.kv.Set(ctx, c.prefix+hash, []byte(accessURL), ttl)
+}
+
+// BoltUploadCache UploadCache persisted in a local bbolt database file, safe to share between goroutines of a process
+type BoltUploadCache struct {
+	*KVUploadCache
+	kv *BoltKV
+}
+
+// NewBoltUploadCache opens the bbolt database at path, it fails if another process holds the database for more than a second
+func NewBoltUploadCache(path string) (*BoltUploadCache, error) {
+	kv, err := NewBoltKV(path)
+	if err != nil {
+		return nil, err
+	}
+	return &BoltUploadCache{KVUploadCache: NewKVUploadCache(kv, ""), kv: kv}, nil
+}
+
+// Close closes the database
+func (c *BoltUploadCache) Close() error {
+	return c.kv.Close()
+}
+
+// hashingReader computes the sha256 of a non seekable content while it is uploaded
+type hashingReader struct {
+	r io.Reader
+	h hash.Hash
+}
+
+func (r *hashingReader) Read(p []byte) (int, error) {
+	n, err := r.r.Read(p)
+	r.h.Write(p[:n])
+	return n, err
+}
+
+func (r *hashingReader) sum() string {
+	return hex.EncodeToString(r.h.Sum(nil))
+}
+
+// seekerHash returns the hex encoded sha256 of the remaining content of the seeker and rewinds it
+func seekerHash(r io.ReadSeeker) (string, error) {
+	offset, err := r.Seek(0, io.SeekCurrent)
+	if err != nil {
+		return "", err
+	}
+	h := sha256.New()
+	if _, err := io.Copy(h, r); err != nil {
+		return "", err
+	}
+	if _, err := r.Seek(offset, io.SeekStart); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(h.Sum(nil)), nil
+}
+
+// cachedUpload returns the cached access url of the content or uploads it and caches its access url.
+// Seekable contents are hashed before uploading, other contents are hashed while uploading so they
+// are only served from the cache on later uploads
+func (u *Uploader) cachedUpload(ctx context.Context, req *UploadRequest) (string, error) {
+	var (
+		key    string
+		hasher *hashingReader
+	)
+	if seeker, ok := req.Reader.(io.ReadSeeker); ok {
+		var err error
+		if key, err = seekerHash(seeker); err != nil {
+			return "", err
+		}
+		// a failing cache only costs an upload
+		accessURL, err := u.cache.Get(ctx, key)
+		if err == nil {
+			return accessURL, nil
+		} else if !errors.Is(err, ErrCacheMiss) {
+			u.cacheErr(ctx, fmt.Errorf("read upload cache: %w", err))
+		}
+	} else {
+		hasher = &hashingReader{r: req.Reader, h: sha256.New()}
+		req.Reader = hasher
+	}
+	accessURL, err := u.upload(ctx, req)
+	if err != nil {
+		return "", err
+	}
+	if hasher != nil {
+		key = hasher.sum()
+	}
+	if err := u.cache.Set(ctx, key, accessURL, u.cacheTTL); err != nil {
+		u.cacheErr(ctx, fmt.Errorf("write upload cache: %w", err))
+	}
+	return accessURL, nil
+}
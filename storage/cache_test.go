@@ -0,0 +1,104 @@
+package storage
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"io"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestUploadCache(t *testing.T) {
+	fileCache, err := NewFileUploadCache(filepath.Join(t.TempDir(), "cache.json"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	boltCache, err := NewBoltUploadCache(filepath.Join(t.TempDir(), "cache.db"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer boltCache.Close()
+	kv, err := NewBoltKV(filepath.Join(t.TempDir(), "shared.db"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer kv.Close()
+	caches := map[string]UploadCache{
+		"memory": NewMemoryUploadCache(),
+		"file":   fileCache,
+		"bolt":   boltCache,
+		"kv":     NewKVUploadCache(kv, "upload:"),
+	}
+	content := []byte("reference image")
+	for name, cache := range caches {
+		t.Run(name, func(t *testing.T) {
+			ctx := context.Background()
+			cdn := newFakeCDN(t)
+			u := cdn.uploader(WithUploadCache(cache, time.Hour))
+			// a stream is hashed while uploaded, the seekable reader is served from the cache
+			first, err := u.Upload(ctx, &UploadRequest{Filename: "ref.png", Reader: io.MultiReader(bytes.NewReader(content))})
+			if err != nil {
+				t.Fatal(err)
+			}
+			second, err := u.Upload(ctx, &UploadRequest{Filename: "other.png", Reader: bytes.NewReader(content)})
+			if err != nil {
+				t.Fatal(err)
+			}
+			if first != second {
+				t.Errorf("expect cached url %s, got %s", first, second)
+			}
+			if cdn.uploads != 1 {
+				t.Errorf("expect 1 upload, got %d", cdn.uploads)
+			}
+			if _, err := u.Upload(ctx, &UploadRequest{Filename: "new.png", Reader: bytes.NewReader([]byte("new image"))}); err != nil {
+				t.Fatal(err)
+			}
+			if cdn.uploads != 2 {
+				t.Errorf("expect 2 uploads, got %d", cdn.uploads)
+			}
+		})
+	}
+}
+
+func TestUploadCacheExpiration(t *testing.T) {
+	ctx := context.Background()
+	cache := NewMemoryUploadCache()
+	if err := cache.Set(ctx, "hash", "https://cdn/file", 10*time.Millisecond); err != nil {
+		t.Fatal(err)
+	}
+	if v, err := cache.Get(ctx, "hash"); err != nil || v != "https://cdn/file" {
+		t.Fatalf("unexpected cached url %s, %v", v, err)
+	}
+	time.Sleep(20 * time.Millisecond)
+	if _, err := cache.Get(ctx, "hash"); !errors.Is(err, ErrCacheMiss) {
+		t.Errorf("expect cache miss, got %v", err)
+	}
+}
+
+// failingCache UploadCache failing every read and write
+type failingCache struct{}
+
+func (failingCache) Get(context.Context, string) (string, error) {
+	return "", errors.New("cache unavailable")
+}
+
+func (failingCache) Set(context.Context, string, string, time.Duration) error {
+	return errors.New("cache unavailable")
+}
+
+func TestUploadCacheErrors(t *testing.T) {
+	cdn := newFakeCDN(t)
+	var errs []error
+	u := cdn.uploader(WithUploadCache(failingCache{}, time.Hour), WithCacheErrorHandler(func(ctx context.Context, err error) {
+		errs = append(errs, err)
+	}))
+	// the upload succeeds without the cache and the failures are reported
+	if _, err := u.Upload(context.Background(), &UploadRequest{Filename: "ref.png", Reader: bytes.NewReader([]byte("reference image"))}); err != nil {
+		t.Fatal(err)
+	}
+	if len(errs) != 2 {
+		t.Errorf("expect the read and write failures, got %v", errs)
+	}
+}
@@ -0,0 +1,219 @@
+package storage
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"net/http"
+	"os"
+	"sync"
+)
+
+// chunk a part of the upload content
+type chunk struct {
+	// number part number starting from 1
+	number int
+	// reader content of the part
+	reader io.ReadSeeker
+	// size content length of the part
+	size int64
+	// release returns the buffer backing the chunk to the pool
+	release func()
+}
+
+// trackedBody request body marking its tracker done when closed
+type trackedBody struct {
+	io.ReadCloser
+	once sync.Once
+	done func()
+}
+
+func (b *trackedBody) Close() error {
+	err := b.ReadCloser.Close()
+	b.once.Do(b.done)
+	return err
+}
+
+// trackBodies counts the bodies of the request and its retries in wg until they are closed
+func trackBodies(req *http.Request, wg *sync.WaitGroup) {
+	if req.Body == nil || req.Body == http.NoBody {
+		return
+	}
+	wg.Add(1)
+	req.Body = &trackedBody{ReadCloser: req.Body, done: wg.Done}
+	if getBody := req.GetBody; getBody != nil {
+		req.GetBody = func() (io.ReadCloser, error) {
+			body, err := getBody()
+			if err != nil {
+				return nil, err
+			}
+			wg.Add(1)
+			return &trackedBody{ReadCloser: body, done: wg.Done}, nil
+		}
+	}
+}
+
+// chunkSource splits the upload content into chunks, next returns io.EOF when there is no chunk left
+type chunkSource interface {
+	next() (*chunk, error)
+}
+
+// sectionSource chunk source reading sections of an io.ReaderAt without buffering
+type sectionSource struct {
+	r         io.ReaderAt
+	offset    int64
+	size      int64
+	chunkSize int64
+	number    int
+}
+
+func (s *sectionSource) next() (*chunk, error) {
+	start := int64(s.number) * s.chunkSize
+	if start >= s.size {
+		return nil, io.EOF
+	}
+	n := min(s.chunkSize, s.size-start)
+	s.number++
+	return &chunk{
+		number:  s.number,
+		reader:  io.NewSectionReader(s.r, s.offset+start, n),
+		size:    n,
+		release: func() {},
+	}, nil
+}
+
+// streamSource chunk source reading an io.Reader sequentially into pooled buffers
+type streamSource struct {
+	r      io.Reader
+	pool   *bufferPool
+	number int
+	eof    bool
+}
+
+func (s *streamSource) next() (*chunk, error) {
+	if s.eof {
+		return nil, io.EOF
+	}
+	buf := s.pool.get()
+	n, err := io.ReadFull(s.r, buf)
+	if err != nil {
+		if !errors.Is(err, io.EOF) && !errors.Is(err, io.ErrUnexpectedEOF) {
+			s.pool.put(buf)
+			return nil, err
+		}
+		s.eof = true
+		if n == 0 {
+			s.pool.put(buf)
+			return nil, io.EOF
+		}
+	}
+	s.number++
+	return &chunk{
+		number:  s.number,
+		reader:  bytes.NewReader(buf[:n]),
+		size:    int64(n),
+		release: func() { s.pool.put(buf) },
+	}, nil
+}
+
+// bufferPool bounded pool of chunk buffers, get blocks when all buffers are in use
+type bufferPool struct {
+	size int64
+	free chan []byte
+	sem  chan struct{}
+}
+
+func newBufferPool(n int, size int64) *bufferPool {
+	return &bufferPool{
+		size: size,
+		free: make(chan []byte, n),
+		sem:  make(chan struct{}, n),
+	}
+}
+
+func (p *bufferPool) get() []byte {
+	select {
+	case buf := <-p.free:
+		return buf
+	default:
+	}
+	select {
+	case buf := <-p.free:
+		return buf
+	case p.sem <- struct{}{}:
+		return make([]byte, p.size)
+	}
+}
+
+func (p *bufferPool) put(buf []byte) {
+	p.free <- buf[:cap(buf)]
+}
+
+// contentSize detects the remaining size of the reader, returns -1 if unknown
+func contentSize(r io.Reader, hint int64) int64 {
+	if hint > 0 {
+		return hint
+	}
+	switch v := r.(type) {
+	case interface{ Len() int }:
+		return int64(v.Len())
+	case interface{ Stat() (os.FileInfo, error) }:
+		info, err := v.Stat()
+		if err != nil || !info.Mode().IsRegular() {
+			return -1
+		}
+		var offset int64
+		if seeker, ok := r.(io.Seeker); ok {
+			if offset, err = seeker.Seek(0, io.SeekCurrent); err != nil {
+				return -1
+			}
+		}
+		return info.Size() - offset
+	case io.Seeker:
+		offset, err := v.Seek(0, io.SeekCurrent)
+		if err != nil {
+			return -1
+		}
+		end, err := v.Seek(0, io.SeekEnd)
+		if err != nil {
+			return -1
+		}
+		if _, err := v.Seek(offset, io.SeekStart); err != nil {
+			return -1
+		}
+		return end - offset
+	}
+	return -1
+}
+
+// newChunkSource picks a section source for readers supporting io.ReaderAt and a stream source otherwise
+func (u *Uploader) newChunkSource(r io.Reader, size int64, chunkSize int64) chunkSource {
+	if ra, ok := r.(io.ReaderAt); ok && size >= 0 {
+		if offset, err := readerOffset(r); err == nil {
+			return &sectionSource{r: ra, offset: offset, size: size, chunkSize: chunkSize}
+		}
+	}
+	return &streamSource{r: r, pool: newBufferPool(u.threads, chunkSize)}
+}
+
+// readerOffset returns the current offset of a seekable reader, 0 otherwise
+func readerOffset(r io.Reader) (int64, error) {
+	if seeker, ok := r.(io.Seeker); ok {
+		return seeker.Seek(0, io.SeekCurrent)
+	}
+	return 0, nil
+}
+
+// prependSource chunk source returning the head chunk before the chunks of src
+type prependSource struct {
+	head *chunk
+	src  chunkSource
+}
+
+func (s *prependSource) next() (*chunk, error) {
+	if head := s.head; head != nil {
+		s.head = nil
+		return head, nil
+	}
+	return s.src.next()
+}
@@ -0,0 +1,61 @@
+package storage
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"strings"
+	"testing"
+)
+
+func TestChunkSource(t *testing.T) {
+	content := strings.Repeat("0123456789", 10)
+	u := &Uploader{chunkSize: 16, threads: 2}
+	tests := []struct {
+		name   string
+		reader func() io.Reader
+		size   int64
+	}{
+		{name: "reader at", reader: func() io.Reader { return strings.NewReader(content) }, size: int64(len(content))},
+		{name: "stream", reader: func() io.Reader { return io.MultiReader(strings.NewReader(content)) }, size: -1},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			src := u.newChunkSource(tt.reader(), tt.size, u.chunkSize)
+			var buf bytes.Buffer
+			for number := 1; ; number++ {
+				c, err := src.next()
+				if errors.Is(err, io.EOF) {
+					break
+				} else if err != nil {
+					t.Fatal(err)
+				}
+				if c.number != number {
+					t.Errorf("expect part %d, got %d", number, c.number)
+				}
+				if c.size > u.chunkSize {
+					t.Errorf("part %d exceeds chunk size: %d", c.number, c.size)
+				}
+				io.Copy(&buf, c.reader)
+				c.release()
+			}
+			if buf.String() != content {
+				t.Errorf("content mismatch: %s", buf.String())
+			}
+		})
+	}
+}
+
+func TestContentSize(t *testing.T) {
+	r := strings.NewReader("hello world")
+	r.Seek(6, io.SeekStart)
+	if size := contentSize(r, 0); size != 5 {
+		t.Errorf("expect 5, got %d", size)
+	}
+	if size := contentSize(io.MultiReader(r), 0); size != -1 {
+		t.Errorf("expect unknown size, got %d", size)
+	}
+	if size := contentSize(io.MultiReader(r), 42); size != 42 {
+		t.Errorf("expect size hint, got %d", size)
+	}
+}
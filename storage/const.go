@@ -1,7 +1,5 @@
 package storage
 
-import "fmt"
-
 const (
 	RestAPIURL              = "https://rest.alpha.fal.ai"
 	CDNURL                  = "https://v3.fal.media"
@@ -12,6 +10,12 @@ const (
 )
 
 var (
-	TokenStoreURL = fmt.Sprintf("%s/storage/auth/token?storage_type=fal-cdn-v3", RestAPIURL)
-	FileUploadURL = fmt.Sprintf("%s/files/upload", CDNURL)
+	// TokenStoreURL default cdn token api url.
+	//
+	// Deprecated: overriding it has no effect, use WithEndpoints or TokenManager.SetEndpoints instead
+	TokenStoreURL = DefaultEndpoints().TokenURL()
+	// FileUploadURL default single file upload url.
+	//
+	// Deprecated: overriding it has no effect, use WithEndpoints instead
+	FileUploadURL = DefaultEndpoints().FileUploadURL()
 )
@@ -0,0 +1,376 @@
+package storage
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"hash"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"path"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/bububa/falclient"
+)
+
+var (
+	ErrDownload          = errors.New("download failed")
+	ErrChecksumMismatch  = errors.New("checksum mismatch")
+	ErrSizeMismatch      = errors.New("size mismatch")
+	ErrSizeLimitExceeded = errors.New("download size limit exceeded")
+)
+
+const (
+	// DownloadMaxConcurrency default number of concurrent downloads of DownloadAll
+	DownloadMaxConcurrency = 4
+	// downloadResumeAttempts max Range requests resuming an interrupted transfer
+	downloadResumeAttempts = 3
+	// partSuffix suffix of the file an incomplete download is written to
+	partSuffix = ".part"
+)
+
+type DownloaderOption func(*Downloader)
+
+func WithDownloadHTTPClient(clt *http.Client) DownloaderOption {
+	return func(d *Downloader) {
+		d.http = clt
+	}
+}
+
+// WithDownloadRetryPolicy sets the retry policy of download requests, default falclient.DefaultRetryPolicy
+func WithDownloadRetryPolicy(p falclient.RetryPolicy) DownloaderOption {
+	return func(d *Downloader) {
+		d.retry = p
+	}
+}
+
+// WithDownloadThreads sets the number of concurrent downloads of DownloadAll, default DownloadMaxConcurrency
+func WithDownloadThreads(n int) DownloaderOption {
+	return func(d *Downloader) {
+		d.threads = n
+	}
+}
+
+// WithMaxDownloadSize fails downloads larger than size bytes with ErrSizeLimitExceeded
+func WithMaxDownloadSize(size int64) DownloaderOption {
+	return func(d *Downloader) {
+		d.maxSize = size
+	}
+}
+
+// Downloader downloads files hosted on fal storage
+type Downloader struct {
+	http    *http.Client
+	retry   falclient.RetryPolicy
+	threads int
+	maxSize int64
+}
+
+func NewDownloader(opts ...DownloaderOption) *Downloader {
+	ret := &Downloader{
+		http:    http.DefaultClient,
+		retry:   falclient.DefaultRetryPolicy,
+		threads: DownloadMaxConcurrency,
+	}
+	for _, opt := range opts {
+		opt(ret)
+	}
+	if ret.threads <= 0 {
+		ret.threads = DownloadMaxConcurrency
+	}
+	return ret
+}
+
+type DownloadRequest struct {
+	URL string `json:"url,omitempty"`
+	// Filename name of the file created by DownloadToDir, default the last segment of the url
+	Filename string `json:"filename,omitempty"`
+	// SHA256 expected hex encoded sha256 of the content, verified when set
+	SHA256 string `json:"sha256,omitempty"`
+	// Size expected content size, verified when set
+	Size int64 `json:"size,omitempty"`
+}
+
+// verify checks the downloaded content against the expected size and checksum
+func (r *DownloadRequest) verify(h hash.Hash, size int64) error {
+	if r.Size > 0 && size != r.Size {
+		return fmt.Errorf("%w: expect %d bytes, got %d", ErrSizeMismatch, r.Size, size)
+	}
+	if r.SHA256 != "" {
+		if sum := hex.EncodeToString(h.Sum(nil)); !strings.EqualFold(sum, r.SHA256) {
+			return fmt.Errorf("%w: expect sha256 %s, got %s", ErrChecksumMismatch, r.SHA256, sum)
+		}
+	}
+	return nil
+}
+
+// Download writes the content to w and returns the number of bytes written
+func (d *Downloader) Download(ctx context.Context, req *DownloadRequest, w io.Writer) (int64, error) {
+	h := sha256.New()
+	n, err := d.fetch(ctx, req.URL, io.MultiWriter(w, h), 0)
+	if err != nil {
+		return n, err
+	}
+	return n, req.verify(h, n)
+}
+
+// Open returns a reader streaming the content, the size limit is checked against the content length
+// and interrupted transfers are not resumed
+func (d *Downloader) Open(ctx context.Context, req *DownloadRequest) (io.ReadCloser, error) {
+	httpReq, err := http.NewRequestWithContext(ctx, http.MethodGet, req.URL, nil)
+	if err != nil {
+		return nil, errors.Join(ErrDownload, err)
+	}
+	httpReq.Header.Set("User-Agent", UserAgent)
+	httpResp, err := falclient.Do(ctx, d.http, httpReq, d.retry)
+	if err != nil {
+		return nil, errors.Join(ErrDownload, err)
+	}
+	if !falclient.IsSuccess(httpResp.StatusCode) {
+		defer httpResp.Body.Close()
+		return nil, falclient.NewAPIError(httpResp)
+	}
+	if d.maxSize > 0 && httpResp.ContentLength > d.maxSize {
+		httpResp.Body.Close()
+		return nil, fmt.Errorf("%w: %d bytes", ErrSizeLimitExceeded, httpResp.ContentLength)
+	}
+	return httpResp.Body, nil
+}
+
+// DownloadBytes returns the content in memory
+func (d *Downloader) DownloadBytes(ctx context.Context, req *DownloadRequest) ([]byte, error) {
+	var buf bytes.Buffer
+	if _, err := d.Download(ctx, req, &buf); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+// DownloadFile downloads the content to path. The content is written to path.part and renamed once verified,
+// an existing path.part left by an interrupted download is resumed with a Range request
+func (d *Downloader) DownloadFile(ctx context.Context, req *DownloadRequest, dest string) error {
+	part := dest + partSuffix
+	fp, err := os.OpenFile(part, os.O_CREATE|os.O_RDWR, 0o644)
+	if err != nil {
+		return err
+	}
+	h := sha256.New()
+	offset, err := io.Copy(h, fp)
+	if err != nil {
+		fp.Close()
+		return err
+	}
+	n, err := d.fetch(ctx, req.URL, io.MultiWriter(fp, h), offset)
+	if err == nil {
+		err = req.verify(h, n)
+	}
+	if err == nil {
+		err = fp.Sync()
+	}
+	if closeErr := fp.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		// keep the partial content of interrupted transfers to resume them,
+		// api errors are answers of the server and leave nothing worth resuming
+		var apiErr *falclient.APIError
+		if errors.Is(err, ErrChecksumMismatch) || errors.Is(err, ErrSizeMismatch) || errors.Is(err, ErrSizeLimitExceeded) ||
+			errors.As(err, &apiErr) {
+			os.Remove(part)
+		}
+		return err
+	}
+	return os.Rename(part, dest)
+}
+
+// DownloadToDir downloads the content into dir and returns the path of the file
+func (d *Downloader) DownloadToDir(ctx context.Context, req *DownloadRequest, dir string) (string, error) {
+	if err := os.MkdirAll(dir, 0o755); err != nil {
+		return "", err
+	}
+	dest := filepath.Join(dir, downloadFilename(req))
+	if err := d.DownloadFile(ctx, req, dest); err != nil {
+		return "", err
+	}
+	return dest, nil
+}
+
+// DownloadedFile file downloaded by DownloadAll
+type DownloadedFile struct {
+	File
+	// Path path of the downloaded file
+	Path string `json:"path,omitempty"`
+}
+
+// DownloadAll downloads every fal file object of the result into dir concurrently,
+// the result is walked with FindFiles and files with the same name get a numeric suffix
+func (d *Downloader) DownloadAll(ctx context.Context, result any, dir string) ([]DownloadedFile, error) {
+	files, err := FindFiles(result)
+	if err != nil {
+		return nil, err
+	}
+	if err := os.MkdirAll(dir, 0o755); err != nil {
+		return nil, err
+	}
+	ret := make([]DownloadedFile, len(files))
+	// used every assigned name, a suffixed name may collide with the name of another file
+	used := make(map[string]struct{}, len(files))
+	for idx, file := range files {
+		req := DownloadRequest{URL: file.URL, Filename: file.FileName}
+		name := downloadFilename(&req)
+		ext := filepath.Ext(name)
+		base := strings.TrimSuffix(name, ext)
+		for n := 1; ; n++ {
+			if _, ok := used[name]; !ok {
+				break
+			}
+			name = fmt.Sprintf("%s-%d%s", base, n, ext)
+		}
+		used[name] = struct{}{}
+		ret[idx] = DownloadedFile{File: file, Path: filepath.Join(dir, name)}
+	}
+	ctx, cancel := context.WithCancelCause(ctx)
+	defer cancel(nil)
+	var (
+		semaphore = make(chan struct{}, d.threads)
+		wg        sync.WaitGroup
+	)
+	for idx := range ret {
+		select {
+		case semaphore <- struct{}{}:
+		case <-ctx.Done():
+			wg.Wait()
+			return nil, context.Cause(ctx)
+		}
+		wg.Add(1)
+		go func(file *DownloadedFile) {
+			defer wg.Done()
+			defer func() { <-semaphore }()
+			req := DownloadRequest{URL: file.URL, Size: file.FileSize}
+			if err := d.DownloadFile(ctx, &req, file.Path); err != nil {
+				cancel(fmt.Errorf("download %s: %w", file.URL, err))
+			}
+		}(&ret[idx])
+	}
+	wg.Wait()
+	if err := context.Cause(ctx); err != nil {
+		return nil, err
+	}
+	return ret, nil
+}
+
+// downloadFilename returns the base name of the requested filename or of the url path
+func downloadFilename(req *DownloadRequest) string {
+	name := req.Filename
+	if name == "" {
+		if u, err := url.Parse(req.URL); err == nil {
+			name = path.Base(u.Path)
+		}
+	}
+	name = filepath.Base(filepath.FromSlash(name))
+	switch name {
+	case "", ".", "..", string(filepath.Separator):
+		return DefaultFilename + ".bin"
+	}
+	return name
+}
+
+// fetch streams the content from offset into w and returns offset plus the bytes written.
+// Interrupted transfers are resumed with Range requests, servers ignoring Range have the first offset bytes skipped
+func (d *Downloader) fetch(ctx context.Context, rawURL string, w io.Writer, offset int64) (int64, error) {
+	for attempt := 0; ; attempt++ {
+		httpReq, err := http.NewRequestWithContext(ctx, http.MethodGet, rawURL, nil)
+		if err != nil {
+			return offset, errors.Join(ErrDownload, err)
+		}
+		httpReq.Header.Set("User-Agent", UserAgent)
+		if offset > 0 {
+			httpReq.Header.Set("Range", fmt.Sprintf("bytes=%d-", offset))
+		}
+		httpResp, err := falclient.Do(ctx, d.http, httpReq, d.retry)
+		if err != nil {
+			return offset, errors.Join(ErrDownload, err)
+		}
+		n, done, err := d.copyBody(httpResp, w, offset)
+		httpResp.Body.Close()
+		offset += n
+		if done || err == nil {
+			return offset, err
+		}
+		if ctx.Err() != nil || attempt >= downloadResumeAttempts {
+			return offset, errors.Join(ErrDownload, err)
+		}
+	}
+}
+
+// copyBody copies the response body from offset into w,
+// done reports that err is final and the transfer must not be resumed
+func (d *Downloader) copyBody(resp *http.Response, w io.Writer, offset int64) (n int64, done bool, err error) {
+	switch {
+	case resp.StatusCode == http.StatusPartialContent:
+		if start := contentRangeStart(resp.Header.Get("Content-Range")); start != offset {
+			return 0, true, fmt.Errorf("%w: unexpected content range %s", ErrDownload, resp.Header.Get("Content-Range"))
+		}
+	case resp.StatusCode == http.StatusRequestedRangeNotSatisfiable && offset > 0:
+		// the previous transfer already received the whole content
+		if total, ok := contentRangeTotal(resp.Header.Get("Content-Range")); ok && total == offset {
+			return 0, true, nil
+		}
+		return 0, true, falclient.NewAPIError(resp)
+	case falclient.IsSuccess(resp.StatusCode):
+		if offset > 0 {
+			if _, err := io.CopyN(io.Discard, resp.Body, offset); err != nil {
+				return 0, false, err
+			}
+		}
+	default:
+		return 0, true, falclient.NewAPIError(resp)
+	}
+	if d.maxSize > 0 && resp.ContentLength > 0 && offset+resp.ContentLength > d.maxSize {
+		return 0, true, fmt.Errorf("%w: %d bytes", ErrSizeLimitExceeded, offset+resp.ContentLength)
+	}
+	body := io.Reader(resp.Body)
+	if d.maxSize > 0 {
+		body = io.LimitReader(body, d.maxSize-offset+1)
+	}
+	n, err = io.Copy(w, body)
+	if d.maxSize > 0 && offset+n > d.maxSize {
+		return n, true, fmt.Errorf("%w: more than %d bytes", ErrSizeLimitExceeded, d.maxSize)
+	}
+	return n, false, err
+}
+
+// contentRangeStart returns the first byte position of a "bytes start-end/total" header, -1 if invalid
+func contentRangeStart(v string) int64 {
+	v, ok := strings.CutPrefix(v, "bytes ")
+	if !ok {
+		return -1
+	}
+	start, _, ok := strings.Cut(v, "-")
+	if !ok {
+		return -1
+	}
+	ret, err := strconv.ParseInt(start, 10, 64)
+	if err != nil {
+		return -1
+	}
+	return ret
+}
+
+// contentRangeTotal returns the total size of a "bytes */total" header
+func contentRangeTotal(v string) (int64, bool) {
+	_, total, ok := strings.Cut(v, "/")
+	if !ok {
+		return 0, false
+	}
+	ret, err := strconv.ParseInt(total, 10, 64)
+	return ret, err == nil
+}
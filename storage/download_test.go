@@ -0,0 +1,150 @@
+package storage
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/bububa/falclient"
+)
+
+// newFileServer serves content at any path, the first request is aborted after half of the content when interrupt is set
+func newFileServer(t *testing.T, content []byte, interrupt bool) (*httptest.Server, *[]string) {
+	t.Helper()
+	var (
+		ranges []string
+		lock   sync.Mutex
+	)
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		lock.Lock()
+		ranges = append(ranges, r.Header.Get("Range"))
+		first := len(ranges) == 1
+		lock.Unlock()
+		if interrupt && first {
+			w.Header().Set("Content-Length", strconv.Itoa(len(content)))
+			w.Write(content[:len(content)/2])
+			w.(http.Flusher).Flush()
+			panic(http.ErrAbortHandler)
+		}
+		http.ServeContent(w, r, "", time.Time{}, bytes.NewReader(content))
+	}))
+	t.Cleanup(srv.Close)
+	return srv, &ranges
+}
+
+func TestDownload(t *testing.T) {
+	ctx := context.Background()
+	content := bytes.Repeat([]byte("0123456789"), 1000)
+	sum := sha256.Sum256(content)
+	srv, ranges := newFileServer(t, content, true)
+	d := NewDownloader(WithDownloadRetryPolicy(falclient.NoRetry))
+	bs, err := d.DownloadBytes(ctx, &DownloadRequest{URL: srv.URL + "/image.png", SHA256: hex.EncodeToString(sum[:]), Size: int64(len(content))})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(bs, content) {
+		t.Error("downloaded content mismatch")
+	}
+	if len(*ranges) != 2 || (*ranges)[1] != "bytes=5000-" {
+		t.Errorf("expect a resumed range request, got %q", *ranges)
+	}
+	if _, err := d.DownloadBytes(ctx, &DownloadRequest{URL: srv.URL, SHA256: strings.Repeat("0", 64)}); !errors.Is(err, ErrChecksumMismatch) {
+		t.Errorf("expect checksum mismatch, got %v", err)
+	}
+	limited := NewDownloader(WithMaxDownloadSize(100))
+	if _, err := limited.DownloadBytes(ctx, &DownloadRequest{URL: srv.URL}); !errors.Is(err, ErrSizeLimitExceeded) {
+		t.Errorf("expect size limit exceeded, got %v", err)
+	}
+}
+
+func TestDownloadFileResume(t *testing.T) {
+	content := bytes.Repeat([]byte("abcdefghij"), 1000)
+	srv, ranges := newFileServer(t, content, false)
+	dest := filepath.Join(t.TempDir(), "video.mp4")
+	// a previous interrupted download left the first bytes
+	if err := os.WriteFile(dest+partSuffix, content[:3000], 0o644); err != nil {
+		t.Fatal(err)
+	}
+	d := NewDownloader()
+	if err := d.DownloadFile(context.Background(), &DownloadRequest{URL: srv.URL, Size: int64(len(content))}, dest); err != nil {
+		t.Fatal(err)
+	}
+	bs, err := os.ReadFile(dest)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(bs, content) {
+		t.Error("downloaded content mismatch")
+	}
+	if (*ranges)[0] != "bytes=3000-" {
+		t.Errorf("expect resumed range request, got %q", *ranges)
+	}
+	if _, err := os.Stat(dest + partSuffix); !errors.Is(err, os.ErrNotExist) {
+		t.Error("part file should be renamed")
+	}
+}
+
+func TestDownloadFileAPIError(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		http.NotFound(w, r)
+	}))
+	t.Cleanup(srv.Close)
+	dest := filepath.Join(t.TempDir(), "video.mp4")
+	d := NewDownloader()
+	var apiErr *falclient.APIError
+	if err := d.DownloadFile(context.Background(), &DownloadRequest{URL: srv.URL}, dest); !errors.As(err, &apiErr) || apiErr.StatusCode != http.StatusNotFound {
+		t.Fatalf("expect not found api error, got %v", err)
+	}
+	if _, err := os.Stat(dest + partSuffix); !errors.Is(err, os.ErrNotExist) {
+		t.Error("part file should be removed on api errors")
+	}
+}
+
+func TestDownloadAll(t *testing.T) {
+	content := []byte("fake image")
+	srv, _ := newFileServer(t, content, false)
+	result := `{
+		"images": [
+			{"url": "` + srv.URL + `/a/image.png", "width": 1, "height": 1, "content_type": "image/png"},
+			{"url": "` + srv.URL + `/b/image.png", "content_type": "image/png"},
+			{"url": "` + srv.URL + `/c/image.png", "content_type": "image/png"},
+			{"url": "` + srv.URL + `/d/image-1.png", "content_type": "image/png"}
+		],
+		"video": {"url": "` + srv.URL + `/video", "file_name": "clip.mp4", "file_size": 10},
+		"seed": 42,
+		"link": {"url": "https://example.com"}
+	}`
+	files, err := FindFiles(result)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(files) != 5 {
+		t.Fatalf("expect 5 files, got %+v", files)
+	}
+	dir := t.TempDir()
+	downloaded, err := NewDownloader().DownloadAll(context.Background(), []byte(result), dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// every file gets its own name, a suffixed name is not reused
+	expect := []string{"image.png", "image-1.png", "image-2.png", "image-1-1.png", "clip.mp4"}
+	for idx, file := range downloaded {
+		if file.Path != filepath.Join(dir, expect[idx]) {
+			t.Errorf("expect path %s, got %s", expect[idx], file.Path)
+		}
+		if bs, err := os.ReadFile(file.Path); err != nil || !bytes.Equal(bs, content) {
+			t.Errorf("unexpected content of %s: %s, %v", file.Path, bs, err)
+		}
+	}
+}
@@ -0,0 +1,46 @@
+package storage
+
+import (
+	"fmt"
+	"strings"
+)
+
+// Endpoints base urls used by the storage client
+type Endpoints struct {
+	// Rest rest api base url, default RestAPIURL
+	Rest string
+	// CDN cdn base url, default CDNURL
+	CDN string
+}
+
+// DefaultEndpoints returns the public fal.ai endpoints
+func DefaultEndpoints() Endpoints {
+	return Endpoints{
+		Rest: RestAPIURL,
+		CDN:  CDNURL,
+	}
+}
+
+// withDefaults fills the empty endpoints with default values
+func (e Endpoints) withDefaults() Endpoints {
+	def := DefaultEndpoints()
+	if e.Rest == "" {
+		e.Rest = def.Rest
+	}
+	if e.CDN == "" {
+		e.CDN = def.CDN
+	}
+	e.Rest = strings.TrimRight(e.Rest, "/")
+	e.CDN = strings.TrimRight(e.CDN, "/")
+	return e
+}
+
+// TokenURL returns the cdn token api url
+func (e Endpoints) TokenURL() string {
+	return fmt.Sprintf("%s/storage/auth/token?storage_type=fal-cdn-v3", e.Rest)
+}
+
+// FileUploadURL returns the single file upload url
+func (e Endpoints) FileUploadURL() string {
+	return fmt.Sprintf("%s/files/upload", e.CDN)
+}
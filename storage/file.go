@@ -0,0 +1,162 @@
+package storage
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"image"
+	"io"
+	"maps"
+	"net/url"
+	"slices"
+	"strings"
+)
+
+// defaultDownloader downloader used by the File helpers
+var defaultDownloader = NewDownloader()
+
+// File fal file object referenced by model inputs and outputs
+type File struct {
+	URL         string `json:"url"`
+	ContentType string `json:"content_type,omitempty"`
+	FileName    string `json:"file_name,omitempty"`
+	FileSize    int64  `json:"file_size,omitempty"`
+}
+
+// Image fal image object
+type Image struct {
+	File
+	Width  int `json:"width,omitempty"`
+	Height int `json:"height,omitempty"`
+}
+
+// Video fal video object
+type Video struct {
+	File
+}
+
+// Audio fal audio object
+type Audio struct {
+	File
+}
+
+// Mesh fal 3d mesh object, e.g. glb or obj model
+type Mesh struct {
+	File
+}
+
+// Open returns a reader of the file content, data uris are decoded without a request
+func (f File) Open(ctx context.Context) (io.ReadCloser, error) {
+	if strings.HasPrefix(f.URL, "data:") {
+		data, _, err := decodeDataURI(f.URL)
+		if err != nil {
+			return nil, err
+		}
+		return io.NopCloser(bytes.NewReader(data)), nil
+	}
+	return defaultDownloader.Open(ctx, &DownloadRequest{URL: f.URL})
+}
+
+// Bytes downloads the file content in memory, the size is verified when file_size is set
+func (f File) Bytes(ctx context.Context) ([]byte, error) {
+	if strings.HasPrefix(f.URL, "data:") {
+		data, _, err := decodeDataURI(f.URL)
+		return data, err
+	}
+	return defaultDownloader.DownloadBytes(ctx, f.downloadRequest())
+}
+
+// Download downloads the file to dest, the size is verified when file_size is set
+func (f File) Download(ctx context.Context, dest string) error {
+	return defaultDownloader.DownloadFile(ctx, f.downloadRequest(), dest)
+}
+
+// DownloadToDir downloads the file into dir named after file_name or the url, returns the path of the file
+func (f File) DownloadToDir(ctx context.Context, dir string) (string, error) {
+	return defaultDownloader.DownloadToDir(ctx, f.downloadRequest(), dir)
+}
+
+func (f File) downloadRequest() *DownloadRequest {
+	return &DownloadRequest{URL: f.URL, Filename: f.FileName, Size: f.FileSize}
+}
+
+// Decode downloads and decodes the image with the decoders registered in the image package,
+// import the decoders of the expected formats, e.g. _ "image/jpeg", returns the format name
+func (i Image) Decode(ctx context.Context) (image.Image, string, error) {
+	rc, err := i.Open(ctx)
+	if err != nil {
+		return nil, "", err
+	}
+	defer rc.Close()
+	return image.Decode(rc)
+}
+
+// FindFiles walks a result and returns the fal file objects it contains, object keys are visited in sorted order.
+// The result can be raw json ([]byte, json.RawMessage, string) or any value encodable to json.
+// An object is a file when it has a url and a content_type, file_name or file_size, or its url is hosted on fal.media
+func FindFiles(result any) ([]File, error) {
+	var raw []byte
+	switch v := result.(type) {
+	case []byte:
+		raw = v
+	case json.RawMessage:
+		raw = v
+	case string:
+		raw = []byte(v)
+	default:
+		bs, err := json.Marshal(v)
+		if err != nil {
+			return nil, err
+		}
+		raw = bs
+	}
+	var doc any
+	if err := json.Unmarshal(raw, &doc); err != nil {
+		return nil, err
+	}
+	var ret []File
+	walkFiles(doc, &ret)
+	return ret, nil
+}
+
+func walkFiles(v any, ret *[]File) {
+	switch val := v.(type) {
+	case map[string]any:
+		if file, ok := fileObject(val); ok {
+			*ret = append(*ret, file)
+			return
+		}
+		// map iteration is random, keep the results stable
+		for _, k := range slices.Sorted(maps.Keys(val)) {
+			walkFiles(val[k], ret)
+		}
+	case []any:
+		for _, item := range val {
+			walkFiles(item, ret)
+		}
+	}
+}
+
+// fileObject converts the json object to a File if it looks like a fal file object
+func fileObject(obj map[string]any) (File, bool) {
+	rawURL, ok := obj["url"].(string)
+	if !ok || rawURL == "" {
+		return File{}, false
+	}
+	file := File{URL: rawURL}
+	file.ContentType, _ = obj["content_type"].(string)
+	file.FileName, _ = obj["file_name"].(string)
+	if size, ok := obj["file_size"].(float64); ok {
+		file.FileSize = int64(size)
+	}
+	_, hasContentType := obj["content_type"]
+	_, hasFileName := obj["file_name"]
+	_, hasFileSize := obj["file_size"]
+	if hasContentType || hasFileName || hasFileSize {
+		return file, true
+	}
+	if u, err := url.Parse(rawURL); err == nil && (u.Hostname() == "fal.media" || strings.HasSuffix(u.Hostname(), ".fal.media")) {
+		return file, true
+	}
+	return File{}, false
+}
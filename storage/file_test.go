@@ -0,0 +1,77 @@
+package storage
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"image"
+	"image/color"
+	"image/png"
+	"io"
+	"path/filepath"
+	"strconv"
+	"testing"
+)
+
+func TestImageDecode(t *testing.T) {
+	src := image.NewRGBA(image.Rect(0, 0, 3, 2))
+	src.Set(1, 1, color.RGBA{R: 255, A: 255})
+	var buf bytes.Buffer
+	if err := png.Encode(&buf, src); err != nil {
+		t.Fatal(err)
+	}
+	srv, _ := newFileServer(t, buf.Bytes(), false)
+	output := `{"images": [{"url": "` + srv.URL + `/out.png", "width": 3, "height": 2, "content_type": "image/png", "file_size": ` +
+		strconv.Itoa(buf.Len()) + `}]}`
+	var resp struct {
+		Images []Image `json:"images"`
+	}
+	if err := json.Unmarshal([]byte(output), &resp); err != nil {
+		t.Fatal(err)
+	}
+	img := resp.Images[0]
+	if img.Width != 3 || img.Height != 2 || img.ContentType != "image/png" || img.FileSize != int64(buf.Len()) {
+		t.Fatalf("unexpected image: %+v", img)
+	}
+	decoded, format, err := img.Decode(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if format != "png" || decoded.Bounds() != src.Bounds() {
+		t.Errorf("unexpected decoded image %s %v", format, decoded.Bounds())
+	}
+	if r, _, _, _ := decoded.At(1, 1).RGBA(); r != 0xffff {
+		t.Errorf("unexpected pixel: %v", decoded.At(1, 1))
+	}
+	path, err := img.DownloadToDir(context.Background(), t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if filepath.Base(path) != "out.png" {
+		t.Errorf("unexpected path: %s", path)
+	}
+	// the types marshal back to the fal file object shape
+	bs, err := json.Marshal(Video{File: File{URL: "https://v3.fal.media/files/clip.mp4", ContentType: "video/mp4"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(bs) != `{"url":"https://v3.fal.media/files/clip.mp4","content_type":"video/mp4"}` {
+		t.Errorf("unexpected json: %s", bs)
+	}
+}
+
+func TestFileOpenDataURI(t *testing.T) {
+	f := File{URL: "data:text/plain;base64,aGVsbG8="}
+	rc, err := f.Open(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer rc.Close()
+	bs, err := io.ReadAll(rc)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(bs) != "hello" {
+		t.Errorf("unexpected content: %s", bs)
+	}
+}
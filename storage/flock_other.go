@@ -0,0 +1,8 @@
+//go:build !unix
+
+package storage
+
+// lockFile advisory file locks are only supported on unix, writes are still atomic
+func lockFile(string, bool) (func() error, error) {
+	return func() error { return nil }, nil
+}
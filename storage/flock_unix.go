@@ -0,0 +1,28 @@
+//go:build unix
+
+package storage
+
+import (
+	"os"
+	"syscall"
+)
+
+// lockFile takes an advisory lock on the file at path, shared unless exclusive, and returns its release func
+func lockFile(path string, exclusive bool) (func() error, error) {
+	fp, err := os.OpenFile(path, os.O_CREATE|os.O_RDWR, 0o600)
+	if err != nil {
+		return nil, err
+	}
+	how := syscall.LOCK_SH
+	if exclusive {
+		how = syscall.LOCK_EX
+	}
+	if err := syscall.Flock(int(fp.Fd()), how); err != nil {
+		fp.Close()
+		return nil, err
+	}
+	return func() error {
+		defer fp.Close()
+		return syscall.Flock(int(fp.Fd()), syscall.LOCK_UN)
+	}, nil
+}
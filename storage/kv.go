@@ -0,0 +1,86 @@
+package storage
+
+import (
+	"context"
+	"encoding/binary"
+	"errors"
+	"time"
+
+	bolt "go.etcd.io/bbolt"
+)
+
+// ErrKeyNotFound the key does not exist or is expired
+var ErrKeyNotFound = errors.New("key not found")
+
+// KV key-value store with expiration backing the caches and stores of the package,
+// implement it over redis, memcached or alike to share state across processes
+type KV interface {
+	// Get returns the value of the key, ErrKeyNotFound if not exists or expired
+	Get(ctx context.Context, key string) ([]byte, error)
+	// Set stores the value until ttl elapses, ttl <= 0 never expires
+	Set(ctx context.Context, key string, value []byte, ttl time.Duration) error
+	Delete(ctx context.Context, key string) error
+}
+
+// boltBucket bucket of the BoltKV values
+var boltBucket = []byte("falclient")
+
+// BoltKV KV persisted in a local bbolt database file, safe to share between goroutines of a process.
+// Values are prefixed with their big endian unix nano expiration, 0 never expires
+type BoltKV struct {
+	db *bolt.DB
+}
+
+// NewBoltKV opens the bbolt database at path, it fails if another process holds the database for more than a second
+func NewBoltKV(path string) (*BoltKV, error) {
+	db, err := bolt.Open(path, 0o600, &bolt.Options{Timeout: time.Second})
+	if err != nil {
+		return nil, err
+	}
+	if err := db.Update(func(tx *bolt.Tx) error {
+		_, err := tx.CreateBucketIfNotExists(boltBucket)
+		return err
+	}); err != nil {
+		db.Close()
+		return nil, err
+	}
+	return &BoltKV{db: db}, nil
+}
+
+// Close closes the database
+func (s *BoltKV) Close() error {
+	return s.db.Close()
+}
+
+func (s *BoltKV) Get(_ context.Context, key string) ([]byte, error) {
+	var ret []byte
+	err := s.db.View(func(tx *bolt.Tx) error {
+		v := tx.Bucket(boltBucket).Get([]byte(key))
+		if len(v) < 8 {
+			return ErrKeyNotFound
+		}
+		if expireAt := int64(binary.BigEndian.Uint64(v[:8])); expireAt > 0 && expireAt <= time.Now().UnixNano() {
+			return ErrKeyNotFound
+		}
+		ret = append([]byte(nil), v[8:]...)
+		return nil
+	})
+	return ret, err
+}
+
+func (s *BoltKV) Set(_ context.Context, key string, value []byte, ttl time.Duration) error {
+	v := make([]byte, 8+len(value))
+	if ttl > 0 {
+		binary.BigEndian.PutUint64(v[:8], uint64(time.Now().Add(ttl).UnixNano()))
+	}
+	copy(v[8:], value)
+	return s.db.Update(func(tx *bolt.Tx) error {
+		return tx.Bucket(boltBucket).Put([]byte(key), v)
+	})
+}
+
+func (s *BoltKV) Delete(_ context.Context, key string) error {
+	return s.db.Update(func(tx *bolt.Tx) error {
+		return tx.Bucket(boltBucket).Delete([]byte(key))
+	})
+}
@@ -0,0 +1,211 @@
+package storage
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"io"
+	"mime"
+	"net/http"
+	"path/filepath"
+	"strings"
+)
+
+const (
+	// DefaultFilename filename used when it can not be inferred
+	DefaultFilename = "upload"
+	// DefaultContentType content type used when it can not be detected
+	DefaultContentType = "application/octet-stream"
+	// sniffLen max bytes used to detect the content type
+	sniffLen = 512
+)
+
+// preferredExtensions extensions of common content types, mime.ExtensionsByType may return unusual ones first
+var preferredExtensions = map[string]string{
+	"image/jpeg":        ".jpg",
+	"image/png":         ".png",
+	"image/gif":         ".gif",
+	"image/webp":        ".webp",
+	"image/avif":        ".avif",
+	"image/heic":        ".heic",
+	"image/bmp":         ".bmp",
+	"image/svg+xml":     ".svg",
+	"video/mp4":         ".mp4",
+	"video/quicktime":   ".mov",
+	"video/webm":        ".webm",
+	"audio/mpeg":        ".mp3",
+	"audio/mp4":         ".m4a",
+	"audio/wav":         ".wav",
+	"audio/flac":        ".flac",
+	"audio/ogg":         ".ogg",
+	"application/ogg":   ".ogg",
+	"model/gltf-binary": ".glb",
+	"model/gltf+json":   ".gltf",
+	"application/json":  ".json",
+	"application/pdf":   ".pdf",
+	"application/zip":   ".zip",
+	"text/plain":        ".txt",
+	"text/html":         ".html",
+	DefaultContentType:  ".bin",
+}
+
+// typesByExtension content types of the preferred extensions, mime.TypeByExtension only knows them
+// when the host provides a mime.types file
+var typesByExtension = func() map[string]string {
+	ret := make(map[string]string, len(preferredExtensions))
+	for contentType, ext := range preferredExtensions {
+		// .ogg is shared by audio/ogg and application/ogg
+		if _, ok := ret[ext]; !ok || strings.HasPrefix(contentType, "audio/") {
+			ret[ext] = contentType
+		}
+	}
+	return ret
+}()
+
+// typeByExtension returns the content type of the extension, empty if unknown
+func typeByExtension(ext string) string {
+	ext = strings.ToLower(ext)
+	if contentType := mime.TypeByExtension(ext); contentType != "" {
+		return contentType
+	}
+	return typesByExtension[ext]
+}
+
+// signature content detected from its first bytes
+type signature struct {
+	contentType string
+	ext         string
+}
+
+// detectSignature matches the signatures missing from http.DetectContentType
+func detectSignature(head []byte) (signature, bool) {
+	switch {
+	case len(head) >= 12 && bytes.HasPrefix(head, []byte("RIFF")) && bytes.Equal(head[8:12], []byte("WEBP")):
+		return signature{"image/webp", ".webp"}, true
+	case len(head) >= 12 && bytes.HasPrefix(head, []byte("RIFF")) && bytes.Equal(head[8:12], []byte("WAVE")):
+		return signature{"audio/wav", ".wav"}, true
+	case bytes.HasPrefix(head, []byte("fLaC")):
+		return signature{"audio/flac", ".flac"}, true
+	case bytes.HasPrefix(head, []byte("glTF")):
+		return signature{"model/gltf-binary", ".glb"}, true
+	case len(head) >= 12 && bytes.Equal(head[4:8], []byte("ftyp")):
+		switch string(head[8:12]) {
+		case "qt  ":
+			return signature{"video/quicktime", ".mov"}, true
+		case "M4A ", "M4B ":
+			return signature{"audio/mp4", ".m4a"}, true
+		case "avif", "avis":
+			return signature{"image/avif", ".avif"}, true
+		case "heic", "heix", "mif1":
+			return signature{"image/heic", ".heic"}, true
+		}
+		return signature{"video/mp4", ".mp4"}, true
+	case isSafetensors(head):
+		return signature{DefaultContentType, ".safetensors"}, true
+	}
+	return signature{}, false
+}
+
+// isSafetensors a safetensors file starts with the little endian size of its json header
+func isSafetensors(head []byte) bool {
+	if len(head) < 10 {
+		return false
+	}
+	size := binary.LittleEndian.Uint64(head[:8])
+	return size > 0 && size < 100*1024*1024 && head[8] == '{' && head[9] == '"'
+}
+
+// DetectContentType detects the content type of the first bytes of a content,
+// it extends http.DetectContentType with webp, mp4, wav, flac, glb and safetensors signatures
+func DetectContentType(head []byte) string {
+	if sig, ok := detectSignature(head); ok {
+		return sig.contentType
+	}
+	return http.DetectContentType(head)
+}
+
+// ExtensionByType returns the file extension of the content type, .bin if unknown
+func ExtensionByType(contentType string) string {
+	mediaType, _, err := mime.ParseMediaType(contentType)
+	if err != nil {
+		mediaType = contentType
+	}
+	if ext, ok := preferredExtensions[mediaType]; ok {
+		return ext
+	}
+	if exts, err := mime.ExtensionsByType(mediaType); err == nil && len(exts) > 0 {
+		return exts[0]
+	}
+	return ".bin"
+}
+
+// peekHead reads the first bytes of the reader without consuming them,
+// returns the reader to use instead of r for non seekable readers
+func peekHead(r io.Reader) ([]byte, io.Reader, error) {
+	head := make([]byte, sniffLen)
+	switch v := r.(type) {
+	case io.ReadSeeker:
+		offset, err := v.Seek(0, io.SeekCurrent)
+		if err != nil {
+			break
+		}
+		n, err := io.ReadFull(v, head)
+		if err != nil && !errors.Is(err, io.EOF) && !errors.Is(err, io.ErrUnexpectedEOF) {
+			return nil, r, err
+		}
+		if _, err := v.Seek(offset, io.SeekStart); err != nil {
+			return nil, r, err
+		}
+		return head[:n], r, nil
+	}
+	n, err := io.ReadFull(r, head)
+	if err != nil && !errors.Is(err, io.EOF) && !errors.Is(err, io.ErrUnexpectedEOF) {
+		return nil, r, err
+	}
+	head = head[:n]
+	return head, io.MultiReader(bytes.NewReader(head), r), nil
+}
+
+// inferFileInfo fills the missing filename and content type of the request
+// from the reader name, the filename extension and the first bytes of the content
+func inferFileInfo(req *UploadRequest) error {
+	if req.Filename == "" {
+		if named, ok := req.Reader.(interface{ Name() string }); ok && named.Name() != "" {
+			req.Filename = filepath.Base(named.Name())
+		}
+	}
+	var sig signature
+	if req.ContentType == "" && req.Filename != "" {
+		req.ContentType = typeByExtension(filepath.Ext(req.Filename))
+	}
+	if req.ContentType == "" {
+		// the size of a reader wrapped for sniffing can not be detected anymore
+		if req.Size <= 0 {
+			if size := contentSize(req.Reader, 0); size > 0 {
+				req.Size = size
+			}
+		}
+		head, reader, err := peekHead(req.Reader)
+		if err != nil {
+			return err
+		}
+		req.Reader = reader
+		if v, ok := detectSignature(head); ok {
+			sig = v
+		} else if len(head) > 0 {
+			sig.contentType = http.DetectContentType(head)
+		}
+		req.ContentType = sig.contentType
+	}
+	if req.ContentType == "" {
+		req.ContentType = DefaultContentType
+	}
+	if req.Filename == "" {
+		ext := sig.ext
+		if ext == "" {
+			ext = ExtensionByType(req.ContentType)
+		}
+		req.Filename = DefaultFilename + ext
+	}
+	return nil
+}
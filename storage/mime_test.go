@@ -0,0 +1,99 @@
+package storage
+
+import (
+	"bytes"
+	"encoding/binary"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestDetectContentType(t *testing.T) {
+	safetensors := binary.LittleEndian.AppendUint64(nil, 64)
+	safetensors = append(safetensors, `{"weight":{"dtype":"F16"}}`...)
+	tests := []struct {
+		name        string
+		head        []byte
+		contentType string
+	}{
+		{name: "png", head: []byte("\x89PNG\r\n\x1a\n\x00\x00\x00\rIHDR"), contentType: "image/png"},
+		{name: "jpeg", head: []byte("\xff\xd8\xff\xe0\x00\x10JFIF"), contentType: "image/jpeg"},
+		{name: "webp", head: []byte("RIFF\x00\x00\x00\x00WEBPVP8 "), contentType: "image/webp"},
+		{name: "wav", head: []byte("RIFF\x00\x00\x00\x00WAVEfmt "), contentType: "audio/wav"},
+		{name: "flac", head: []byte("fLaC\x00\x00\x00\x22"), contentType: "audio/flac"},
+		{name: "mp4", head: []byte("\x00\x00\x00\x20ftypisom\x00\x00\x02\x00"), contentType: "video/mp4"},
+		{name: "mov", head: []byte("\x00\x00\x00\x14ftypqt  \x00\x00\x00\x00"), contentType: "video/quicktime"},
+		{name: "glb", head: []byte("glTF\x02\x00\x00\x00"), contentType: "model/gltf-binary"},
+		{name: "safetensors", head: safetensors, contentType: DefaultContentType},
+		{name: "text", head: []byte("hello world"), contentType: "text/plain; charset=utf-8"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := DetectContentType(tt.head); got != tt.contentType {
+				t.Errorf("expect %s, got %s", tt.contentType, got)
+			}
+		})
+	}
+}
+
+func TestInferFileInfo(t *testing.T) {
+	fp, err := os.Create(filepath.Join(t.TempDir(), "cat.jpeg"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer fp.Close()
+	safetensors := binary.LittleEndian.AppendUint64(nil, 64)
+	safetensors = append(safetensors, `{"weight":{"dtype":"F16"}}`...)
+
+	webp := []byte("RIFF\x00\x00\x00\x00WEBPVP8 ")
+	tests := []struct {
+		name        string
+		req         UploadRequest
+		content     []byte
+		filename    string
+		contentType string
+		size        int64
+	}{
+		{name: "os file", req: UploadRequest{Reader: fp}, filename: "cat.jpeg", contentType: "image/jpeg"},
+		{name: "extension", req: UploadRequest{Filename: "voice.flac", Reader: strings.NewReader("")}, filename: "voice.flac", contentType: "audio/flac"},
+		{name: "sniff seekable", req: UploadRequest{Reader: bytes.NewReader(webp)}, content: webp, filename: "upload.webp", contentType: "image/webp"},
+		{name: "sniff buffer", req: UploadRequest{Reader: bytes.NewBuffer(webp)}, content: webp, filename: "upload.webp", contentType: "image/webp", size: int64(len(webp))},
+		{name: "sniff stream", req: UploadRequest{Reader: io.MultiReader(bytes.NewReader(safetensors))}, content: safetensors, filename: "upload.safetensors", contentType: DefaultContentType},
+		{name: "content type", req: UploadRequest{ContentType: "image/png", Reader: strings.NewReader("")}, filename: "upload.png", contentType: "image/png"},
+		{name: "empty", req: UploadRequest{Reader: strings.NewReader("")}, filename: "upload.bin", contentType: DefaultContentType},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			req := tt.req
+			if err := inferFileInfo(&req); err != nil {
+				t.Fatal(err)
+			}
+			if req.Filename != tt.filename {
+				t.Errorf("expect filename %s, got %s", tt.filename, req.Filename)
+			}
+			if req.ContentType != tt.contentType {
+				t.Errorf("expect content type %s, got %s", tt.contentType, req.ContentType)
+			}
+			if tt.size > 0 && req.Size != tt.size {
+				t.Errorf("expect size %d, got %d", tt.size, req.Size)
+			}
+			if content, _ := io.ReadAll(req.Reader); !bytes.Equal(content, tt.content) {
+				t.Error("content consumed by sniffing")
+			}
+		})
+	}
+}
+
+func TestTypeByExtension(t *testing.T) {
+	// the fallback table does not depend on the mime.types file of the host
+	for ext, contentType := range map[string]string{".flac": "audio/flac", ".wav": "audio/wav", ".mp4": "video/mp4", ".glb": "model/gltf-binary", ".ogg": "audio/ogg"} {
+		if got := typesByExtension[ext]; got != contentType {
+			t.Errorf("expect %s for %s, got %s", contentType, ext, got)
+		}
+		if got := typeByExtension(strings.ToUpper(ext)); got == "" {
+			t.Errorf("expect a content type for %s", ext)
+		}
+	}
+}
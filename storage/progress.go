@@ -0,0 +1,230 @@
+package storage
+
+import (
+	"context"
+	"io"
+	"net/http"
+	"sync"
+	"time"
+)
+
+// progressInterval min interval between two progress reports of transferred bytes
+const progressInterval = 100 * time.Millisecond
+
+// UploadProgress progress of an upload
+type UploadProgress struct {
+	Filename string `json:"filename,omitempty"`
+	// BytesSent bytes sent so far
+	BytesSent int64 `json:"bytes_sent,omitempty"`
+	// TotalBytes content size, -1 if unknown
+	TotalBytes int64 `json:"total_bytes,omitempty"`
+	// PartsCompleted number of completed parts
+	PartsCompleted int `json:"parts_completed,omitempty"`
+	// TotalParts number of parts, 0 if unknown
+	TotalParts int `json:"total_parts,omitempty"`
+	// Throughput average bytes per second since the upload started
+	Throughput float64 `json:"throughput,omitempty"`
+	// ETA estimated remaining time, 0 if unknown
+	ETA time.Duration `json:"eta,omitempty"`
+}
+
+// ProgressFunc receives upload progress reports, calls are serialized and should return quickly
+type ProgressFunc func(UploadProgress)
+
+// progressTracker aggregates the transferred bytes of the parts of an upload
+type progressTracker struct {
+	fn         ProgressFunc
+	filename   string
+	total      int64
+	totalParts int
+	start      time.Time
+	lastReport time.Time
+	sent       map[int]int64
+	sentTotal  int64
+	completed  int
+	lock       sync.Mutex
+}
+
+func newProgressTracker(fn ProgressFunc, filename string, total int64, chunkSize int64) *progressTracker {
+	if fn == nil {
+		return nil
+	}
+	ret := &progressTracker{
+		fn:       fn,
+		filename: filename,
+		total:    total,
+		start:    time.Now(),
+		sent:     make(map[int]int64),
+	}
+	if total >= 0 && chunkSize > 0 {
+		ret.totalParts = int((total + chunkSize - 1) / chunkSize)
+	}
+	return ret
+}
+
+// add records n bytes sent for the part
+func (t *progressTracker) add(part int, n int64) {
+	if t == nil {
+		return
+	}
+	t.lock.Lock()
+	defer t.lock.Unlock()
+	t.sent[part] += n
+	t.sentTotal += n
+	if now := time.Now(); now.Sub(t.lastReport) >= progressInterval {
+		t.report(now)
+	}
+}
+
+// reset discards the bytes sent for the part before a retry
+func (t *progressTracker) reset(part int) {
+	if t == nil {
+		return
+	}
+	t.lock.Lock()
+	defer t.lock.Unlock()
+	t.sentTotal -= t.sent[part]
+	t.sent[part] = 0
+}
+
+// sentOf returns the bytes sent for the part
+func (t *progressTracker) sentOf(part int) int64 {
+	if t == nil {
+		return 0
+	}
+	t.lock.Lock()
+	defer t.lock.Unlock()
+	return t.sent[part]
+}
+
+// completePart marks the part of size bytes completed
+func (t *progressTracker) completePart(part int, size int64) {
+	if t == nil {
+		return
+	}
+	t.lock.Lock()
+	defer t.lock.Unlock()
+	t.sentTotal += size - t.sent[part]
+	t.sent[part] = size
+	t.completed++
+	t.report(time.Now())
+}
+
+// report calls the progress func, must be called with the lock held
+func (t *progressTracker) report(now time.Time) {
+	t.lastReport = now
+	ret := UploadProgress{
+		Filename:       t.filename,
+		BytesSent:      t.sentTotal,
+		TotalBytes:     t.total,
+		PartsCompleted: t.completed,
+		TotalParts:     t.totalParts,
+	}
+	if elapsed := now.Sub(t.start).Seconds(); elapsed > 0 {
+		ret.Throughput = float64(t.sentTotal) / elapsed
+	}
+	if ret.Throughput > 0 && t.total >= t.sentTotal {
+		ret.ETA = time.Duration(float64(t.total-t.sentTotal) / ret.Throughput * float64(time.Second))
+	}
+	t.fn(ret)
+}
+
+// rateLimiter token bucket shared by all the concurrent transfers of an uploader
+type rateLimiter struct {
+	rate   float64
+	tokens float64
+	last   time.Time
+	lock   sync.Mutex
+}
+
+func newRateLimiter(bytesPerSec int64) *rateLimiter {
+	if bytesPerSec <= 0 {
+		return nil
+	}
+	return &rateLimiter{
+		rate: float64(bytesPerSec),
+		last: time.Now(),
+	}
+}
+
+// burst max bytes allowed at once
+func (l *rateLimiter) burst() int {
+	return max(int(l.rate/10), 1)
+}
+
+// wait blocks until n bytes can be transferred
+func (l *rateLimiter) wait(ctx context.Context, n int) error {
+	if l == nil {
+		return nil
+	}
+	l.lock.Lock()
+	now := time.Now()
+	l.tokens = min(l.tokens+now.Sub(l.last).Seconds()*l.rate, float64(l.burst()))
+	l.last = now
+	l.tokens -= float64(n)
+	var delay time.Duration
+	if l.tokens < 0 {
+		delay = time.Duration(-l.tokens / l.rate * float64(time.Second))
+	}
+	l.lock.Unlock()
+	if delay <= 0 {
+		return nil
+	}
+	timer := time.NewTimer(delay)
+	defer timer.Stop()
+	select {
+	case <-ctx.Done():
+		return ctx.Err()
+	case <-timer.C:
+		return nil
+	}
+}
+
+// meteredReader reports the bytes read to the progress tracker and throttles them with the rate limiter
+type meteredReader struct {
+	ctx     context.Context
+	r       io.ReadCloser
+	part    int
+	tracker *progressTracker
+	limiter *rateLimiter
+}
+
+func (r *meteredReader) Read(p []byte) (int, error) {
+	if r.limiter != nil {
+		if burst := r.limiter.burst(); len(p) > burst {
+			p = p[:burst]
+		}
+	}
+	n, err := r.r.Read(p)
+	r.tracker.add(r.part, int64(n))
+	// throttle the bytes actually read before handing them to the transport
+	if n > 0 {
+		if waitErr := r.limiter.wait(r.ctx, n); waitErr != nil {
+			return n, waitErr
+		}
+	}
+	return n, err
+}
+
+func (r *meteredReader) Close() error {
+	return r.r.Close()
+}
+
+// meter wraps the request body to report progress and limit the bandwidth
+func (u *Uploader) meter(req *http.Request, part int, tracker *progressTracker) {
+	if (tracker == nil && u.limiter == nil) || req.Body == nil || req.Body == http.NoBody {
+		return
+	}
+	ctx := req.Context()
+	req.Body = &meteredReader{ctx: ctx, r: req.Body, part: part, tracker: tracker, limiter: u.limiter}
+	if getBody := req.GetBody; getBody != nil {
+		req.GetBody = func() (io.ReadCloser, error) {
+			body, err := getBody()
+			if err != nil {
+				return nil, err
+			}
+			tracker.reset(part)
+			return &meteredReader{ctx: ctx, r: body, part: part, tracker: tracker, limiter: u.limiter}, nil
+		}
+	}
+}
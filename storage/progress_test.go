@@ -0,0 +1,72 @@
+package storage
+
+import (
+	"bytes"
+	"context"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestUploadProgress(t *testing.T) {
+	content := bytes.Repeat([]byte("x"), 10000)
+	tests := []struct {
+		name      string
+		threshold int64
+		parts     int
+	}{
+		{name: "single", threshold: MultipartThreshold, parts: 1},
+		{name: "multipart", threshold: 1000, parts: 10},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			cdn := newFakeCDN(t)
+			var (
+				lock    sync.Mutex
+				reports []UploadProgress
+			)
+			u := cdn.uploader(WithChunkSize(1000), WithThreads(3), WithMultipartThreshold(tt.threshold), WithProgress(func(p UploadProgress) {
+				lock.Lock()
+				reports = append(reports, p)
+				lock.Unlock()
+			}))
+			if _, err := u.Upload(context.Background(), &UploadRequest{Filename: "multipart.bin", Reader: bytes.NewReader(content)}); err != nil {
+				t.Fatal(err)
+			}
+			if len(reports) == 0 {
+				t.Fatal("no progress reported")
+			}
+			var last int64
+			for _, p := range reports {
+				if p.BytesSent < last {
+					t.Errorf("bytes sent decreased: %d < %d", p.BytesSent, last)
+				}
+				last = p.BytesSent
+			}
+			final := reports[len(reports)-1]
+			if final.BytesSent != int64(len(content)) || final.TotalBytes != int64(len(content)) {
+				t.Errorf("unexpected final bytes: %+v", final)
+			}
+			if final.PartsCompleted != tt.parts || final.TotalParts != tt.parts {
+				t.Errorf("unexpected final parts: %+v", final)
+			}
+			if final.ETA != 0 {
+				t.Errorf("expect zero eta, got %s", final.ETA)
+			}
+		})
+	}
+}
+
+func TestRateLimit(t *testing.T) {
+	cdn := newFakeCDN(t)
+	u := cdn.uploader(WithChunkSize(1000), WithThreads(4), WithMultipartThreshold(1000), WithRateLimit(20000))
+	content := bytes.Repeat([]byte("x"), 8000)
+	start := time.Now()
+	if _, err := u.Upload(context.Background(), &UploadRequest{Reader: bytes.NewReader(content)}); err != nil {
+		t.Fatal(err)
+	}
+	// the first burst of rate/10 bytes is not throttled
+	if elapsed := time.Since(start); elapsed < 300*time.Millisecond {
+		t.Errorf("expect upload throttled to at least 300ms, took %s", elapsed)
+	}
+}
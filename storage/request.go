@@ -1,11 +1,18 @@
 package storage
 
-import "io"
+import (
+	"io"
+	"sync"
+)
 
 type UploadRequest struct {
 	Filename    string    `json:"filename,omitempty"`
 	ContentType string    `json:"content_type,omitempty"`
 	Reader      io.Reader `json:"-"`
+	// Size size hint of the content, detected from the reader if not set
+	Size int64 `json:"size,omitempty"`
+	// tracker progress tracker of the upload
+	tracker *progressTracker
 }
 
 type UploadPartRequest struct {
@@ -13,6 +20,12 @@ type UploadPartRequest struct {
 	ContentType string    `json:"content_type,omitempty"`
 	PartNumber  int       `json:"part_number,omitempty"`
 	Reader      io.Reader `json:"-"`
+	// Size content length of the part
+	Size int64 `json:"size,omitempty"`
+	// tracker progress tracker of the upload
+	tracker *progressTracker
+	// bodies counts the request bodies of the part not closed yet
+	bodies *sync.WaitGroup
 }
 
 type CompleteUploadRequest struct {
@@ -0,0 +1,209 @@
+package storage
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"slices"
+	"sync"
+	"time"
+)
+
+var (
+	ErrUploadStateNotFound = errors.New("upload state not found")
+	ErrUploadStateMismatch = errors.New("upload state mismatch")
+)
+
+// PartState state of an uploaded part
+type PartState struct {
+	UploadPart
+	Size   int64  `json:"size,omitempty"`
+	SHA256 string `json:"sha256,omitempty"`
+}
+
+// UploadState persisted state of a multipart upload
+type UploadState struct {
+	CreateUploadResult
+	Filename    string `json:"filename,omitempty"`
+	ContentType string `json:"content_type,omitempty"`
+	ChunkSize   int64  `json:"chunk_size,omitempty"`
+	// Size content size, 0 if unknown when the upload was created
+	Size      int64       `json:"size,omitempty"`
+	Parts     []PartState `json:"parts,omitempty"`
+	UpdatedAt time.Time   `json:"updated_at,omitzero"`
+}
+
+// ResumeStore persists the state of multipart uploads
+type ResumeStore interface {
+	// Load loads the upload state, returns ErrUploadStateNotFound if not exists
+	Load(ctx context.Context, uploadID string, state *UploadState) error
+	Save(ctx context.Context, state *UploadState) error
+	Delete(ctx context.Context, uploadID string) error
+}
+
+// ResumableError error of a multipart upload which can be resumed with Uploader.Resume
+type ResumableError struct {
+	UploadID string
+	Err      error
+}
+
+func (e *ResumableError) Error() string {
+	return fmt.Sprintf("upload %s interrupted: %s", e.UploadID, e.Err)
+}
+
+func (e *ResumableError) Unwrap() error {
+	return e.Err
+}
+
+// MemoryResumeStore in-memory ResumeStore
+type MemoryResumeStore struct {
+	states map[string]UploadState
+	lock   sync.RWMutex
+}
+
+func NewMemoryResumeStore() *MemoryResumeStore {
+	return &MemoryResumeStore{
+		states: make(map[string]UploadState),
+	}
+}
+
+func (s *MemoryResumeStore) Load(_ context.Context, uploadID string, state *UploadState) error {
+	s.lock.RLock()
+	defer s.lock.RUnlock()
+	v, ok := s.states[uploadID]
+	if !ok {
+		return ErrUploadStateNotFound
+	}
+	*state = v
+	state.Parts = slices.Clone(v.Parts)
+	return nil
+}
+
+func (s *MemoryResumeStore) Save(_ context.Context, state *UploadState) error {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	v := *state
+	v.Parts = slices.Clone(state.Parts)
+	s.states[state.UploadID] = v
+	return nil
+}
+
+func (s *MemoryResumeStore) Delete(_ context.Context, uploadID string) error {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	delete(s.states, uploadID)
+	return nil
+}
+
+// FileResumeStore ResumeStore persisting each upload state as a json file in a directory
+type FileResumeStore struct {
+	dir  string
+	lock sync.Mutex
+}
+
+func NewFileResumeStore(dir string) (*FileResumeStore, error) {
+	if err := os.MkdirAll(dir, 0o755); err != nil {
+		return nil, err
+	}
+	return &FileResumeStore{dir: dir}, nil
+}
+
+func (s *FileResumeStore) path(uploadID string) string {
+	sum := sha256.Sum256([]byte(uploadID))
+	return filepath.Join(s.dir, hex.EncodeToString(sum[:16])+".json")
+}
+
+func (s *FileResumeStore) Load(_ context.Context, uploadID string, state *UploadState) error {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	bs, err := os.ReadFile(s.path(uploadID))
+	if err != nil {
+		if errors.Is(err, os.ErrNotExist) {
+			return ErrUploadStateNotFound
+		}
+		return err
+	}
+	return json.Unmarshal(bs, state)
+}
+
+func (s *FileResumeStore) Save(_ context.Context, state *UploadState) error {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	bs, err := json.Marshal(state)
+	if err != nil {
+		return err
+	}
+	return writeFileAtomic(s.path(state.UploadID), bs)
+}
+
+func (s *FileResumeStore) Delete(_ context.Context, uploadID string) error {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	if err := os.Remove(s.path(uploadID)); err != nil && !errors.Is(err, os.ErrNotExist) {
+		return err
+	}
+	return nil
+}
+
+// writeFileAtomic writes the data to a temp file and renames it over path
+func writeFileAtomic(path string, data []byte) error {
+	fp, err := os.CreateTemp(filepath.Dir(path), filepath.Base(path)+".*.tmp")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(fp.Name())
+	if _, err := fp.Write(data); err != nil {
+		fp.Close()
+		return err
+	}
+	if err := fp.Sync(); err != nil {
+		fp.Close()
+		return err
+	}
+	if err := fp.Close(); err != nil {
+		return err
+	}
+	return os.Rename(fp.Name(), path)
+}
+
+// chunkHash returns the hex encoded sha256 of the chunk and rewinds it
+func chunkHash(c *chunk) (string, error) {
+	h := sha256.New()
+	if _, err := io.Copy(h, c.reader); err != nil {
+		return "", err
+	}
+	if _, err := c.reader.Seek(0, io.SeekStart); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(h.Sum(nil)), nil
+}
+
+// Resume resumes an interrupted multipart upload recorded in the resume store.
+// The reader must provide the same content as the original upload, a reader of a different size
+// fails with ErrUploadStateMismatch. Recorded parts whose size and sha256 still match are skipped,
+// the other parts are uploaded before completing the upload
+func (u *Uploader) Resume(ctx context.Context, uploadID string, reader io.Reader) (string, error) {
+	if u.resumeStore == nil {
+		return "", errors.New("resume store not set")
+	}
+	var state UploadState
+	if err := u.resumeStore.Load(ctx, uploadID, &state); err != nil {
+		return "", err
+	}
+	if state.ChunkSize <= 0 {
+		return "", fmt.Errorf("%w: invalid chunk size %d", ErrUploadStateMismatch, state.ChunkSize)
+	}
+	size := contentSize(reader, 0)
+	if state.Size > 0 && size >= 0 && size != state.Size {
+		return "", fmt.Errorf("%w: expect %d bytes, got %d", ErrUploadStateMismatch, state.Size, size)
+	}
+	src := u.newChunkSource(reader, size, state.ChunkSize)
+	tracker := newProgressTracker(u.progress, state.Filename, size, state.ChunkSize)
+	return u.uploadParts(ctx, &state, src, tracker)
+}
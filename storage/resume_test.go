@@ -0,0 +1,93 @@
+package storage
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"io"
+	"testing"
+)
+
+func TestResume(t *testing.T) {
+	fileStore, err := NewFileResumeStore(t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+	stores := map[string]ResumeStore{
+		"memory": NewMemoryResumeStore(),
+		"file":   fileStore,
+	}
+	content := bytes.Repeat([]byte("0123456789abcdef"), 500)
+	for name, store := range stores {
+		t.Run(name, func(t *testing.T) {
+			ctx := context.Background()
+			cdn := newFakeCDN(t)
+			cdn.failPart = 5
+			u := cdn.uploader(WithChunkSize(1000), WithThreads(1), WithMultipartThreshold(1000), WithResumeStore(store))
+			_, err := u.Upload(ctx, &UploadRequest{Reader: bytes.NewReader(content)})
+			var resumable *ResumableError
+			if !errors.As(err, &resumable) {
+				t.Fatalf("expect resumable error, got %v", err)
+			}
+			var state UploadState
+			if err := store.Load(ctx, resumable.UploadID, &state); err != nil {
+				t.Fatal(err)
+			}
+			if len(state.Parts) != 4 {
+				t.Fatalf("expect 4 recorded parts, got %d", len(state.Parts))
+			}
+
+			cdn.failPart = 0
+			// corrupt a recorded part so that it is uploaded again
+			state.Parts[1].SHA256 = "corrupted"
+			store.Save(ctx, &state)
+			accessURL, err := u.Resume(ctx, resumable.UploadID, bytes.NewReader(content))
+			if err != nil {
+				t.Fatal(err)
+			}
+			if accessURL != cdn.URL+"/files/multipart.bin" {
+				t.Errorf("unexpected access url: %s", accessURL)
+			}
+			for part, expect := range map[int]int{1: 1, 2: 2, 3: 1, 4: 1, 5: 2, 6: 1, 8: 1} {
+				if got := cdn.puts[part]; got != expect {
+					t.Errorf("part %d: expect %d uploads, got %d", part, expect, got)
+				}
+			}
+			if !bytes.Equal(cdn.assembled(), content) {
+				t.Error("assembled content mismatch")
+			}
+			if err := store.Load(ctx, resumable.UploadID, &state); !errors.Is(err, ErrUploadStateNotFound) {
+				t.Errorf("expect state deleted, got %v", err)
+			}
+		})
+	}
+}
+
+func TestResumeTruncated(t *testing.T) {
+	content := bytes.Repeat([]byte("0123456789abcdef"), 500)
+	ctx := context.Background()
+	cdn := newFakeCDN(t)
+	cdn.failPart = 5
+	store := NewMemoryResumeStore()
+	u := cdn.uploader(WithChunkSize(1000), WithThreads(1), WithMultipartThreshold(1000), WithResumeStore(store))
+	_, err := u.Upload(ctx, &UploadRequest{Reader: bytes.NewReader(content)})
+	var resumable *ResumableError
+	if !errors.As(err, &resumable) {
+		t.Fatalf("expect resumable error, got %v", err)
+	}
+	cdn.failPart = 0
+	// the recorded size rejects a shorter reader of known size
+	if _, err := u.Resume(ctx, resumable.UploadID, bytes.NewReader(content[:2000])); !errors.Is(err, ErrUploadStateMismatch) {
+		t.Errorf("expect state mismatch, got %v", err)
+	}
+	// recorded parts past the end of a stream reject the completion
+	if _, err := u.Resume(ctx, resumable.UploadID, io.LimitReader(bytes.NewReader(content), 2000)); !errors.Is(err, ErrUploadStateMismatch) {
+		t.Errorf("expect state mismatch, got %v", err)
+	}
+	if _, err := u.Resume(ctx, resumable.UploadID, bytes.NewReader(content)); err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(cdn.assembled(), content) {
+		t.Error("assembled content mismatch")
+	}
+}
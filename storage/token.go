@@ -6,9 +6,12 @@ import (
 	"encoding/json"
 	"errors"
 	"fmt"
-	"io"
 	"net/http"
+	"sync"
 	"time"
+
+	"github.com/bububa/falclient"
+	"github.com/bububa/falclient/internal/flight"
 )
 
 var (
@@ -70,11 +73,15 @@ type TokenStore interface {
 	Set(context.Context, *Token) error
 }
 
+// MemoryTokenStore in-memory TokenStore, the zero value is ready to use and safe for concurrent use
 type MemoryTokenStore struct {
 	token *Token
+	lock  sync.RWMutex
 }
 
 func (s *MemoryTokenStore) Get(ctx context.Context, token *Token) error {
+	s.lock.RLock()
+	defer s.lock.RUnlock()
 	if s.token == nil {
 		return ErrTokenNotFound
 	} else if s.token.Expired() {
@@ -85,21 +92,43 @@ func (s *MemoryTokenStore) Get(ctx context.Context, token *Token) error {
 }
 
 func (s *MemoryTokenStore) Set(ctx context.Context, token *Token) error {
-	s.token = token
+	v := *token
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	s.token = &v
 	return nil
 }
 
+const (
+	// DefaultTokenRefreshSkew default duration before expiration a token is refreshed
+	DefaultTokenRefreshSkew = time.Minute
+	// DefaultTokenRefreshTimeout default max duration of a token refresh shared by concurrent callers
+	DefaultTokenRefreshTimeout = 30 * time.Second
+)
+
 type TokenManager struct {
-	http  *http.Client
-	key   string
-	store TokenStore
+	http      *http.Client
+	retry     falclient.RetryPolicy
+	key       string
+	store     TokenStore
+	endpoints Endpoints
+	skew      time.Duration
+	timeout   time.Duration
+	// invalid token rejected by the cdn
+	invalid  string
+	inflight flight.Group[struct{}, Token]
+	lock     sync.Mutex
 }
 
 func NewTokenManager(key string, store TokenStore) *TokenManager {
 	return &TokenManager{
-		key:   key,
-		store: store,
-		http:  http.DefaultClient,
+		key:       key,
+		store:     store,
+		http:      http.DefaultClient,
+		retry:     falclient.DefaultRetryPolicy,
+		endpoints: DefaultEndpoints(),
+		skew:      DefaultTokenRefreshSkew,
+		timeout:   DefaultTokenRefreshTimeout,
 	}
 }
 
@@ -107,22 +136,66 @@ func (m *TokenManager) SetHTTPClient(clt *http.Client) {
 	m.http = clt
 }
 
+// SetRetryPolicy sets the retry policy of token requests
+func (m *TokenManager) SetRetryPolicy(p falclient.RetryPolicy) {
+	m.retry = p
+}
+
+// SetEndpoints overrides the fal.ai endpoints, empty fields fallback to defaults
+func (m *TokenManager) SetEndpoints(v Endpoints) {
+	m.endpoints = v.withDefaults()
+}
+
+// SetRefreshSkew sets the duration before expiration a token is refreshed, default DefaultTokenRefreshSkew.
+// The skew is capped to half of the token lifetime
+func (m *TokenManager) SetRefreshSkew(d time.Duration) {
+	m.skew = max(d, 0)
+}
+
+// SetRefreshTimeout bounds a token refresh, default DefaultTokenRefreshTimeout.
+// The refresh outlives the caller which started it and would otherwise block the later callers sharing it
+func (m *TokenManager) SetRefreshTimeout(d time.Duration) {
+	if d > 0 {
+		m.timeout = d
+	}
+}
+
+// Refresh fetches a new token and stores it, concurrent calls share a single request
 func (m *TokenManager) Refresh(ctx context.Context, token *Token) error {
-	httpReq, err := http.NewRequestWithContext(ctx, http.MethodPost, TokenStoreURL, bytes.NewReader([]byte("{}")))
+	ret, err := m.inflight.Do(ctx, struct{}{}, m.timeout, func(ctx context.Context) (Token, error) {
+		var ret Token
+		if err := m.refresh(ctx, &ret); err != nil {
+			return ret, err
+		}
+		m.lock.Lock()
+		m.invalid = ""
+		m.lock.Unlock()
+		return ret, nil
+	})
+	if err != nil {
+		return err
+	}
+	*token = ret
+	return nil
+}
+
+func (m *TokenManager) refresh(ctx context.Context, token *Token) error {
+	httpReq, err := http.NewRequestWithContext(ctx, http.MethodPost, m.endpoints.TokenURL(), bytes.NewReader([]byte("{}")))
 	if err != nil {
 		return fmt.Errorf("refresh token failed: %w", err)
 	}
 	httpReq.Header.Set("Authorization", fmt.Sprintf("Key %s", m.key))
 	httpReq.Header.Set("Accept", "application/json")
 	httpReq.Header.Set("Content-Type", "application/json")
-	httpResp, err := m.http.Do(httpReq)
+	// minting a token has no side effect, it is retried as an idempotent request
+	httpReq.Header["Idempotency-Key"] = nil
+	httpResp, err := falclient.Do(ctx, m.http, httpReq, m.retry)
 	if err != nil {
 		return errors.Join(ErrRefreshTokenFailed, err)
 	}
 	defer httpResp.Body.Close()
-	if httpResp.StatusCode < 200 || httpResp.StatusCode >= 300 {
-		body, _ := io.ReadAll(httpResp.Body)
-		return fmt.Errorf("%w, %s", ErrRefreshTokenFailed, string(body))
+	if !falclient.IsSuccess(httpResp.StatusCode) {
+		return errors.Join(ErrRefreshTokenFailed, falclient.NewAPIError(httpResp))
 	}
 	if err := json.NewDecoder(httpResp.Body).Decode(token); err != nil {
 		return fmt.Errorf("refresh token failed: %w", err)
@@ -130,6 +203,8 @@ func (m *TokenManager) Refresh(ctx context.Context, token *Token) error {
 	return m.store.Set(ctx, token)
 }
 
+// Token returns the stored token, it is refreshed when missing, invalidated or about to expire.
+// A token about to expire is still returned when its refresh fails
 func (m *TokenManager) Token(ctx context.Context, token *Token) error {
 	if err := m.store.Get(ctx, token); err != nil {
 		if errors.Is(err, ErrTokenNotFound) || errors.Is(err, ErrTokenExpired) {
@@ -137,5 +212,37 @@ func (m *TokenManager) Token(ctx context.Context, token *Token) error {
 		}
 		return fmt.Errorf("get token failed:%w", err)
 	}
+	if !m.stale(token) {
+		return nil
+	}
+	if err := m.Refresh(ctx, token); err != nil && (m.invalidated(token) || token.Expired()) {
+		return err
+	}
 	return nil
 }
+
+// Invalidate marks the token rejected by the cdn, the next Token call refreshes it
+func (m *TokenManager) Invalidate(token *Token) {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	m.invalid = token.Token
+}
+
+// invalidated reports whether the token was rejected by the cdn
+func (m *TokenManager) invalidated(token *Token) bool {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	return m.invalid != "" && token.Token == m.invalid
+}
+
+// stale reports whether the token was invalidated or expires within the refresh skew
+func (m *TokenManager) stale(token *Token) bool {
+	if m.invalidated(token) {
+		return true
+	}
+	skew := m.skew
+	if !token.CreatedAt.IsZero() {
+		skew = min(skew, token.ExpireAt.Time().Sub(token.CreatedAt.Time())/2)
+	}
+	return time.Now().Add(skew).After(token.ExpireAt.Time())
+}
@@ -0,0 +1,118 @@
+package storage
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+)
+
+// DefaultTokenKey default KV key of the cdn token
+const DefaultTokenKey = "falclient:cdn-token"
+
+// FileTokenStore TokenStore persisting the token as a json file.
+// Writes are atomic and serialized with an advisory lock on path.lock so that processes of a host can share the token
+type FileTokenStore struct {
+	path string
+	lock sync.RWMutex
+}
+
+// NewFileTokenStore creates a FileTokenStore at path, the file is created on first write
+func NewFileTokenStore(path string) (*FileTokenStore, error) {
+	if err := os.MkdirAll(filepath.Dir(path), 0o700); err != nil {
+		return nil, err
+	}
+	return &FileTokenStore{path: path}, nil
+}
+
+func (s *FileTokenStore) Get(_ context.Context, token *Token) error {
+	s.lock.RLock()
+	defer s.lock.RUnlock()
+	unlock, err := lockFile(s.path+".lock", false)
+	if err != nil {
+		return err
+	}
+	defer unlock()
+	bs, err := os.ReadFile(s.path)
+	if err != nil {
+		if errors.Is(err, os.ErrNotExist) {
+			return ErrTokenNotFound
+		}
+		return err
+	}
+	var v Token
+	if err := json.Unmarshal(bs, &v); err != nil {
+		return err
+	}
+	if v.Expired() {
+		return ErrTokenExpired
+	}
+	*token = v
+	return nil
+}
+
+func (s *FileTokenStore) Set(_ context.Context, token *Token) error {
+	bs, err := json.Marshal(token)
+	if err != nil {
+		return err
+	}
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	unlock, err := lockFile(s.path+".lock", true)
+	if err != nil {
+		return err
+	}
+	defer unlock()
+	return writeFileAtomic(s.path, bs)
+}
+
+// KVTokenStore TokenStore backed by a KV, use a shared KV to share the token across a fleet
+type KVTokenStore struct {
+	kv  KV
+	key string
+}
+
+// NewKVTokenStore creates a KVTokenStore storing the token under key, DefaultTokenKey if empty
+func NewKVTokenStore(kv KV, key string) *KVTokenStore {
+	if key == "" {
+		key = DefaultTokenKey
+	}
+	return &KVTokenStore{kv: kv, key: key}
+}
+
+func (s *KVTokenStore) Get(ctx context.Context, token *Token) error {
+	bs, err := s.kv.Get(ctx, s.key)
+	if err != nil {
+		if errors.Is(err, ErrKeyNotFound) {
+			return ErrTokenNotFound
+		}
+		return err
+	}
+	var v Token
+	if err := json.Unmarshal(bs, &v); err != nil {
+		return err
+	}
+	if v.Expired() {
+		return ErrTokenExpired
+	}
+	*token = v
+	return nil
+}
+
+// Set stores the token until it expires
+func (s *KVTokenStore) Set(ctx context.Context, token *Token) error {
+	var ttl time.Duration
+	if !token.ExpireAt.IsZero() {
+		if ttl = time.Until(token.ExpireAt.Time()); ttl <= 0 {
+			return ErrTokenExpired
+		}
+	}
+	bs, err := json.Marshal(token)
+	if err != nil {
+		return err
+	}
+	return s.kv.Set(ctx, s.key, bs, ttl)
+}
@@ -3,8 +3,20 @@ package storage
 import (
 	"context"
 	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
 	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"sync/atomic"
 	"testing"
+	"time"
+
+	"github.com/bububa/falclient"
 )
 
 func TestTokenManager(t *testing.T) {
@@ -20,3 +32,213 @@ func TestTokenManager(t *testing.T) {
 		t.Log(string(bs))
 	}
 }
+
+func TestTokenStores(t *testing.T) {
+	dir := t.TempDir()
+	fileStore, err := NewFileTokenStore(filepath.Join(dir, "tokens", "cdn.json"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	kv, err := NewBoltKV(filepath.Join(dir, "tokens.db"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer kv.Close()
+	stores := map[string]TokenStore{
+		"memory": new(MemoryTokenStore),
+		"file":   fileStore,
+		"kv":     NewKVTokenStore(kv, ""),
+	}
+	for name, store := range stores {
+		t.Run(name, func(t *testing.T) {
+			ctx := context.Background()
+			var token Token
+			if err := store.Get(ctx, &token); !errors.Is(err, ErrTokenNotFound) {
+				t.Fatalf("expect token not found, got %v", err)
+			}
+			var wg sync.WaitGroup
+			for i := range 8 {
+				wg.Add(2)
+				go func() {
+					defer wg.Done()
+					store.Set(ctx, &Token{
+						Token:     fmt.Sprintf("token-%d", i),
+						TokenType: "Bearer",
+						ExpireAt:  TokenTime(time.Now().Add(time.Hour)),
+					})
+				}()
+				go func() {
+					defer wg.Done()
+					var v Token
+					store.Get(ctx, &v)
+				}()
+			}
+			wg.Wait()
+			if err := store.Get(ctx, &token); err != nil {
+				t.Fatal(err)
+			}
+			if token.TokenType != "Bearer" || !strings.HasPrefix(token.Token, "token-") {
+				t.Errorf("unexpected token: %+v", token)
+			}
+		})
+	}
+}
+
+func TestFileTokenStoreExpired(t *testing.T) {
+	ctx := context.Background()
+	path := filepath.Join(t.TempDir(), "cdn.json")
+	store, err := NewFileTokenStore(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := store.Set(ctx, &Token{Token: "old", ExpireAt: TokenTime(time.Now().Add(-time.Minute))}); err != nil {
+		t.Fatal(err)
+	}
+	// another process sharing the file sees the same token
+	other, err := NewFileTokenStore(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var token Token
+	if err := other.Get(ctx, &token); !errors.Is(err, ErrTokenExpired) {
+		t.Errorf("expect token expired, got %v", err)
+	}
+}
+
+func TestTokenRefreshSingleFlight(t *testing.T) {
+	var (
+		calls int
+		lock  sync.Mutex
+	)
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		lock.Lock()
+		calls++
+		n := calls
+		lock.Unlock()
+		time.Sleep(50 * time.Millisecond)
+		json.NewEncoder(w).Encode(Token{
+			Token:     fmt.Sprintf("token-%d", n),
+			TokenType: "Bearer",
+			CreatedAt: TokenTime(time.Now()),
+			ExpireAt:  TokenTime(time.Now().Add(time.Hour)),
+		})
+	}))
+	defer srv.Close()
+	store := new(MemoryTokenStore)
+	m := NewTokenManager("key", store)
+	m.SetEndpoints(Endpoints{Rest: srv.URL})
+	var wg sync.WaitGroup
+	for range 10 {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			var token Token
+			if err := m.Token(context.Background(), &token); err != nil {
+				t.Error(err)
+			} else if token.Token != "token-1" {
+				t.Errorf("unexpected token: %s", token.Token)
+			}
+		}()
+	}
+	wg.Wait()
+	if calls != 1 {
+		t.Fatalf("expect 1 refresh, got %d", calls)
+	}
+	// a token expiring within the skew is refreshed ahead of time
+	store.Set(context.Background(), &Token{
+		Token:     "expiring",
+		CreatedAt: TokenTime(time.Now().Add(-time.Hour)),
+		ExpireAt:  TokenTime(time.Now().Add(30 * time.Second)),
+	})
+	var token Token
+	if err := m.Token(context.Background(), &token); err != nil {
+		t.Fatal(err)
+	}
+	if calls != 2 || token.Token != "token-2" {
+		t.Errorf("expect proactive refresh, got %d calls and %s", calls, token.Token)
+	}
+	m.Invalidate(&token)
+	if err := m.Token(context.Background(), &token); err != nil {
+		t.Fatal(err)
+	}
+	if calls != 3 || token.Token != "token-3" {
+		t.Errorf("expect refresh of the invalidated token, got %d calls and %s", calls, token.Token)
+	}
+}
+
+func TestTokenRefreshRetried(t *testing.T) {
+	var calls atomic.Int32
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if calls.Add(1) == 1 {
+			w.WriteHeader(http.StatusBadGateway)
+			return
+		}
+		json.NewEncoder(w).Encode(Token{Token: "token", ExpireAt: TokenTime(time.Now().Add(time.Hour))})
+	}))
+	defer srv.Close()
+	m := NewTokenManager("key", new(MemoryTokenStore))
+	m.SetEndpoints(Endpoints{Rest: srv.URL})
+	m.SetRetryPolicy(&falclient.BackoffPolicy{MaxAttempts: 3, BaseDelay: time.Millisecond})
+	var token Token
+	if err := m.Token(context.Background(), &token); err != nil {
+		t.Fatal(err)
+	}
+	if token.Token != "token" || calls.Load() != 2 {
+		t.Errorf("expect token after a retry, got %q after %d calls", token.Token, calls.Load())
+	}
+}
+
+func TestTokenRefreshTimeout(t *testing.T) {
+	var calls atomic.Int32
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		// the first request never gets an answer
+		if calls.Add(1) == 1 {
+			io.Copy(io.Discard, r.Body)
+			<-r.Context().Done()
+			return
+		}
+		json.NewEncoder(w).Encode(Token{Token: "token", ExpireAt: TokenTime(time.Now().Add(time.Hour))})
+	}))
+	defer srv.Close()
+	m := NewTokenManager("key", new(MemoryTokenStore))
+	m.SetEndpoints(Endpoints{Rest: srv.URL})
+	m.SetRetryPolicy(falclient.NoRetry)
+	m.SetRefreshTimeout(50 * time.Millisecond)
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+	var token Token
+	if err := m.Token(ctx, &token); !errors.Is(err, context.DeadlineExceeded) {
+		t.Fatalf("expect deadline exceeded, got %v", err)
+	}
+	// the hung refresh ends with its own timeout instead of blocking the later callers
+	time.Sleep(100 * time.Millisecond)
+	ctx, cancel = context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+	if err := m.Token(ctx, &token); err != nil {
+		t.Fatal(err)
+	}
+	if token.Token != "token" {
+		t.Errorf("unexpected token: %s", token.Token)
+	}
+}
+
+func TestTokenProactiveRefreshFailure(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusBadGateway)
+	}))
+	defer srv.Close()
+	store := new(MemoryTokenStore)
+	m := NewTokenManager("key", store)
+	m.SetEndpoints(Endpoints{Rest: srv.URL})
+	m.SetRetryPolicy(falclient.NoRetry)
+	store.Set(context.Background(), &Token{Token: "expiring", ExpireAt: TokenTime(time.Now().Add(30 * time.Second))})
+	// the token refreshed ahead of its expiration is still usable
+	var token Token
+	if err := m.Token(context.Background(), &token); err != nil || token.Token != "expiring" {
+		t.Fatalf("expect the stored token, got %q: %v", token.Token, err)
+	}
+	m.Invalidate(&token)
+	if err := m.Token(context.Background(), &token); !errors.Is(err, ErrRefreshTokenFailed) {
+		t.Errorf("expect refresh failure of the invalidated token, got %v", err)
+	}
+}
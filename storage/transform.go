@@ -0,0 +1,461 @@
+package storage
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"image"
+	"image/png"
+	"io"
+	"maps"
+	"net/url"
+	"os"
+	"reflect"
+	"regexp"
+	"strings"
+	"sync"
+)
+
+// ErrInvalidDataURI the string looks like a data uri but can not be decoded
+var ErrInvalidDataURI = errors.New("invalid data uri")
+
+// dataURIHeader strict data uri header: data:<type>/<subtype>[;param=value]*[;base64],
+var dataURIHeader = regexp.MustCompile(`^data:[\w!#$&^.+-]+/[\w!#$&^.+-]+(;[\w!#$&^.+-]+=[^;,]*)*(;base64)?,`)
+
+const (
+	// TransformMaxConcurrency default number of concurrent uploads of TransformInput
+	TransformMaxConcurrency = 4
+)
+
+// transformSpillThreshold size above which io.Reader values are buffered in a temp file instead of memory
+var transformSpillThreshold int64 = MultipartChunkSize
+
+var (
+	jsonMarshalerType = reflect.TypeFor[json.Marshaler]()
+	readerType        = reflect.TypeFor[io.Reader]()
+	imageType         = reflect.TypeFor[image.Image]()
+	osFileType        = reflect.TypeFor[*os.File]()
+)
+
+// uploadJob content to upload, shared by the input values with the same content hash
+type uploadJob struct {
+	data []byte
+	file *os.File
+	// spilled the file is a temp file of size bytes buffering an io.Reader value
+	spilled     bool
+	size        int64
+	contentType string
+	url         string
+}
+
+// inputTransformer collects the binary values of an input
+type inputTransformer struct {
+	jobs  map[string]*uploadJob
+	temps []*os.File
+}
+
+// TransformInput walks maps, slices and structs of the input and replaces io.Reader, []byte, *os.File,
+// image.Image and data uri values with the url of their content uploaded to fal storage.
+// Contents are deduplicated by hash and uploaded concurrently, containers without binary values are returned as is.
+// io.Reader values larger than a multipart chunk are buffered in temp files removed once the input is transformed
+func (u *Uploader) TransformInput(ctx context.Context, input any) (any, error) {
+	t := inputTransformer{jobs: make(map[string]*uploadJob)}
+	defer t.cleanup()
+	ret, changed, err := t.collect(reflect.ValueOf(input))
+	if err != nil || !changed {
+		return input, err
+	}
+	if err := u.uploadJobs(ctx, t.jobs); err != nil {
+		return nil, err
+	}
+	return resolveJobs(ret), nil
+}
+
+// uploadJobs uploads the jobs concurrently
+func (u *Uploader) uploadJobs(ctx context.Context, jobs map[string]*uploadJob) error {
+	ctx, cancel := context.WithCancelCause(ctx)
+	defer cancel(nil)
+	var (
+		semaphore = make(chan struct{}, u.transformThreads)
+		wg        sync.WaitGroup
+	)
+	for _, job := range jobs {
+		select {
+		case semaphore <- struct{}{}:
+		case <-ctx.Done():
+			return context.Cause(ctx)
+		}
+		wg.Add(1)
+		go func(job *uploadJob) {
+			defer wg.Done()
+			defer func() { <-semaphore }()
+			req := UploadRequest{ContentType: job.contentType}
+			switch {
+			case job.spilled:
+				// the name of the temp file says nothing of the content
+				req.Reader = io.NewSectionReader(job.file, 0, job.size)
+			case job.file != nil:
+				req.Reader = job.file
+			default:
+				req.Reader = bytes.NewReader(job.data)
+			}
+			accessURL, err := u.Upload(ctx, &req)
+			if err != nil {
+				cancel(err)
+				return
+			}
+			job.url = accessURL
+		}(job)
+	}
+	wg.Wait()
+	return context.Cause(ctx)
+}
+
+// resolveJobs replaces the jobs in the containers built by collect with their urls
+func resolveJobs(v any) any {
+	switch val := v.(type) {
+	case *uploadJob:
+		return val.url
+	case map[string]any:
+		for k, item := range val {
+			val[k] = resolveJobs(item)
+		}
+	case []any:
+		for i, item := range val {
+			val[i] = resolveJobs(item)
+		}
+	}
+	return v
+}
+
+// add registers the content and returns the job uploading it
+func (t *inputTransformer) add(data []byte, file *os.File, contentType string) (*uploadJob, error) {
+	h := sha256.New()
+	if file != nil {
+		offset, err := file.Seek(0, io.SeekCurrent)
+		if err != nil {
+			return nil, err
+		}
+		if _, err := io.Copy(h, file); err != nil {
+			return nil, err
+		}
+		if _, err := file.Seek(offset, io.SeekStart); err != nil {
+			return nil, err
+		}
+	} else {
+		h.Write(data)
+	}
+	key := hex.EncodeToString(h.Sum(nil))
+	if job, ok := t.jobs[key]; ok {
+		return job, nil
+	}
+	job := &uploadJob{data: data, file: file, contentType: contentType}
+	t.jobs[key] = job
+	return job, nil
+}
+
+// addReader registers the content of the reader, contents larger than transformSpillThreshold
+// are buffered in a temp file instead of memory
+func (t *inputTransformer) addReader(r io.Reader) (*uploadJob, error) {
+	data, err := io.ReadAll(io.LimitReader(r, transformSpillThreshold+1))
+	if err != nil {
+		return nil, err
+	}
+	if int64(len(data)) <= transformSpillThreshold {
+		return t.add(data, nil, "")
+	}
+	fp, err := os.CreateTemp("", "falclient-input-*")
+	if err != nil {
+		return nil, err
+	}
+	t.temps = append(t.temps, fp)
+	if _, err := fp.Write(data); err != nil {
+		return nil, err
+	}
+	n, err := io.Copy(fp, r)
+	if err != nil {
+		return nil, err
+	}
+	if _, err := fp.Seek(0, io.SeekStart); err != nil {
+		return nil, err
+	}
+	job, err := t.add(nil, fp, "")
+	if err != nil {
+		return nil, err
+	}
+	if job.file == fp {
+		job.spilled = true
+		job.size = int64(len(data)) + n
+	}
+	return job, nil
+}
+
+// cleanup removes the temp files buffering io.Reader values
+func (t *inputTransformer) cleanup() {
+	for _, fp := range t.temps {
+		fp.Close()
+		os.Remove(fp.Name())
+	}
+}
+
+// collect returns the value with binary values replaced by upload jobs and whether the value was changed
+func (t *inputTransformer) collect(v reflect.Value) (any, bool, error) {
+	if !v.IsValid() {
+		return nil, false, nil
+	}
+	if job, ok, err := t.leaf(v); err != nil || ok {
+		return job, ok, err
+	}
+	switch v.Kind() {
+	case reflect.Pointer, reflect.Interface:
+		if v.IsNil() {
+			return v.Interface(), false, nil
+		}
+		if v.Kind() == reflect.Pointer && v.Type().Implements(jsonMarshalerType) {
+			return v.Interface(), false, nil
+		}
+		ret, changed, err := t.collect(v.Elem())
+		if err != nil || !changed {
+			return v.Interface(), false, err
+		}
+		return ret, true, nil
+	case reflect.Map:
+		if v.Type().Implements(jsonMarshalerType) {
+			return v.Interface(), false, nil
+		}
+		ret := make(map[string]any, v.Len())
+		var changed bool
+		iter := v.MapRange()
+		for iter.Next() {
+			item, itemChanged, err := t.collect(iter.Value())
+			if err != nil {
+				return nil, false, err
+			}
+			changed = changed || itemChanged
+			ret[mapKey(iter.Key())] = item
+		}
+		if !changed {
+			return v.Interface(), false, nil
+		}
+		return ret, true, nil
+	case reflect.Slice, reflect.Array:
+		if v.Type().Implements(jsonMarshalerType) || v.Kind() == reflect.Slice && v.IsNil() {
+			return v.Interface(), false, nil
+		}
+		ret := make([]any, v.Len())
+		var changed bool
+		for i := range v.Len() {
+			item, itemChanged, err := t.collect(v.Index(i))
+			if err != nil {
+				return nil, false, err
+			}
+			changed = changed || itemChanged
+			ret[i] = item
+		}
+		if !changed {
+			return v.Interface(), false, nil
+		}
+		return ret, true, nil
+	case reflect.Struct:
+		if v.Type().Implements(jsonMarshalerType) || reflect.PointerTo(v.Type()).Implements(jsonMarshalerType) {
+			return v.Interface(), false, nil
+		}
+		fields := make(map[string]any)
+		changed, err := t.collectFields(v, fields)
+		if err != nil || !changed {
+			return v.Interface(), false, err
+		}
+		// encoding/json decides which fields are kept and how, only the uploaded fields are replaced
+		ret, err := structToMap(v)
+		if err != nil {
+			return nil, false, err
+		}
+		maps.Copy(ret, fields)
+		return ret, true, nil
+	}
+	return v.Interface(), false, nil
+}
+
+// collectFields collects the exported fields of the struct holding binary values into ret using their json names
+func (t *inputTransformer) collectFields(v reflect.Value, ret map[string]any) (bool, error) {
+	var changed bool
+	typ := v.Type()
+	for i := range typ.NumField() {
+		field := typ.Field(i)
+		name, opts, _ := strings.Cut(field.Tag.Get("json"), ",")
+		if name == "-" && opts == "" {
+			continue
+		}
+		fv := v.Field(i)
+		if field.Anonymous && name == "" {
+			embedded := fv
+			if embedded.Kind() == reflect.Pointer {
+				if embedded.IsNil() {
+					continue
+				}
+				embedded = embedded.Elem()
+			}
+			if embedded.Kind() == reflect.Struct && embedded.CanInterface() {
+				embeddedChanged, err := t.collectFields(embedded, ret)
+				if err != nil {
+					return false, err
+				}
+				changed = changed || embeddedChanged
+				continue
+			}
+		}
+		if !field.IsExported() {
+			continue
+		}
+		if name == "" {
+			name = field.Name
+		}
+		if hasTagOption(opts, "omitempty") && isEmptyValue(fv) || hasTagOption(opts, "omitzero") && fv.IsZero() {
+			continue
+		}
+		item, itemChanged, err := t.collect(fv)
+		if err != nil {
+			return false, err
+		}
+		if itemChanged {
+			changed = true
+			ret[name] = item
+		}
+	}
+	return changed, nil
+}
+
+// structToMap encodes the struct with encoding/json into a map, numbers are kept as json.Number
+func structToMap(v reflect.Value) (map[string]any, error) {
+	bs, err := json.Marshal(v.Interface())
+	if err != nil {
+		return nil, err
+	}
+	dec := json.NewDecoder(bytes.NewReader(bs))
+	dec.UseNumber()
+	var ret map[string]any
+	if err := dec.Decode(&ret); err != nil {
+		return nil, err
+	}
+	return ret, nil
+}
+
+// hasTagOption reports whether the comma separated json tag options contain the option
+func hasTagOption(opts string, option string) bool {
+	for opts != "" {
+		var opt string
+		opt, opts, _ = strings.Cut(opts, ",")
+		if opt == option {
+			return true
+		}
+	}
+	return false
+}
+
+// isEmptyValue reports whether encoding/json omits the value of an omitempty field
+func isEmptyValue(v reflect.Value) bool {
+	switch v.Kind() {
+	case reflect.Array, reflect.Map, reflect.Slice, reflect.String:
+		return v.Len() == 0
+	case reflect.Bool,
+		reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64,
+		reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64, reflect.Uintptr,
+		reflect.Float32, reflect.Float64,
+		reflect.Interface, reflect.Pointer:
+		return v.IsZero()
+	}
+	return false
+}
+
+// leaf registers the value if it is a binary value
+func (t *inputTransformer) leaf(v reflect.Value) (*uploadJob, bool, error) {
+	typ := v.Type()
+	switch {
+	case typ == osFileType:
+		if v.IsNil() {
+			return nil, false, nil
+		}
+		job, err := t.add(nil, v.Interface().(*os.File), "")
+		return job, true, err
+	case typ.Kind() == reflect.Slice && typ.Elem().Kind() == reflect.Uint8:
+		// json.RawMessage and alike are already encoded
+		if v.IsNil() || typ.Implements(jsonMarshalerType) {
+			return nil, false, nil
+		}
+		job, err := t.add(v.Bytes(), nil, "")
+		return job, true, err
+	case typ.Kind() == reflect.String:
+		str := v.String()
+		// other strings starting with data:, e.g. a prompt, are not data uris
+		if !isDataURI(str) {
+			return nil, false, nil
+		}
+		data, contentType, err := decodeDataURI(str)
+		if err != nil {
+			return nil, false, err
+		}
+		job, err := t.add(data, nil, contentType)
+		return job, true, err
+	case typ.Kind() == reflect.Interface:
+		return nil, false, nil
+	case typ.Implements(imageType):
+		if typ.Kind() == reflect.Pointer && v.IsNil() {
+			return nil, false, nil
+		}
+		var buf bytes.Buffer
+		if err := png.Encode(&buf, v.Interface().(image.Image)); err != nil {
+			return nil, false, err
+		}
+		job, err := t.add(buf.Bytes(), nil, "image/png")
+		return job, true, err
+	case typ.Implements(readerType):
+		if typ.Kind() == reflect.Pointer && v.IsNil() {
+			return nil, false, nil
+		}
+		job, err := t.addReader(v.Interface().(io.Reader))
+		return job, true, err
+	}
+	return nil, false, nil
+}
+
+// mapKey formats the map key as a json object key
+func mapKey(k reflect.Value) string {
+	if k.Kind() == reflect.String {
+		return k.String()
+	}
+	return fmt.Sprint(k.Interface())
+}
+
+// isDataURI reports whether the string starts with a strict data uri header
+func isDataURI(str string) bool {
+	return strings.HasPrefix(str, "data:") && dataURIHeader.MatchString(str)
+}
+
+// decodeDataURI decodes a data:<type>/<subtype>[;param=value]*[;base64],<data> uri
+func decodeDataURI(str string) ([]byte, string, error) {
+	if !isDataURI(str) {
+		return nil, "", ErrInvalidDataURI
+	}
+	meta, payload, _ := strings.Cut(strings.TrimPrefix(str, "data:"), ",")
+	isBase64 := strings.HasSuffix(meta, ";base64")
+	contentType := strings.TrimSuffix(meta, ";base64")
+	if isBase64 {
+		data, err := base64.StdEncoding.DecodeString(payload)
+		if err != nil {
+			if data, err = base64.RawStdEncoding.DecodeString(payload); err != nil {
+				return nil, "", errors.Join(ErrInvalidDataURI, err)
+			}
+		}
+		return data, contentType, nil
+	}
+	data, err := url.PathUnescape(payload)
+	if err != nil {
+		return nil, "", errors.Join(ErrInvalidDataURI, err)
+	}
+	return []byte(data), contentType, nil
+}
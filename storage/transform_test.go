@@ -0,0 +1,172 @@
+package storage
+
+import (
+	"bytes"
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"image"
+	"image/color"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestTransformInput(t *testing.T) {
+	cdn := newFakeCDN(t)
+	u := cdn.uploader(WithThreads(4))
+	img := image.NewRGBA(image.Rect(0, 0, 2, 2))
+	img.Set(0, 0, color.White)
+	fname := filepath.Join(t.TempDir(), "prompt.txt")
+	if err := os.WriteFile(fname, []byte("from file"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	fp, err := os.Open(fname)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer fp.Close()
+	type Inner struct {
+		Mask  image.Image `json:"mask"`
+		Unset []byte      `json:"unset,omitempty"`
+	}
+	type Input struct {
+		Prompt string          `json:"prompt"`
+		Image  []byte          `json:"image_url"`
+		Inner  *Inner          `json:"inner"`
+		Files  []any           `json:"files"`
+		Extra  map[string]any  `json:"extra"`
+		Raw    json.RawMessage `json:"raw"`
+	}
+	input := Input{
+		Prompt: "a cat",
+		Image:  []byte("hello"),
+		Inner:  &Inner{Mask: img},
+		Files:  []any{fp, strings.NewReader("hello"), "data:text/plain;base64," + base64.StdEncoding.EncodeToString([]byte("world"))},
+		Extra:  map[string]any{"seed": 42},
+		Raw:    json.RawMessage(`{"a":1}`),
+	}
+	ret, err := u.TransformInput(context.Background(), input)
+	if err != nil {
+		t.Fatal(err)
+	}
+	bs, err := json.Marshal(ret)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var got map[string]any
+	if err := json.Unmarshal(bs, &got); err != nil {
+		t.Fatal(err)
+	}
+	expect := map[string]any{
+		"prompt":    "a cat",
+		"image_url": cdn.URL + "/files/upload.txt",
+		"inner":     map[string]any{"mask": cdn.URL + "/files/upload.png"},
+		"files":     []any{cdn.URL + "/files/prompt.txt", cdn.URL + "/files/upload.txt", cdn.URL + "/files/upload.txt"},
+		"extra":     map[string]any{"seed": float64(42)},
+		"raw":       map[string]any{"a": float64(1)},
+	}
+	if !reflect.DeepEqual(got, expect) {
+		t.Errorf("unexpected transformed input: %s", bs)
+	}
+	// the two "hello" values are uploaded once
+	if cdn.uploads != 4 {
+		t.Errorf("expect 4 uploads, got %d", cdn.uploads)
+	}
+	if string(cdn.files["prompt.txt"]) != "from file" {
+		t.Errorf("unexpected file content: %s", cdn.files["prompt.txt"])
+	}
+	if input.Files[2] != "data:text/plain;base64,"+base64.StdEncoding.EncodeToString([]byte("world")) {
+		t.Error("input should not be modified")
+	}
+}
+
+func TestTransformInputUnchanged(t *testing.T) {
+	u := NewUploader("key", new(MemoryTokenStore))
+	input := map[string]any{"prompt": "a cat", "sizes": []int{1, 2}}
+	ret, err := u.TransformInput(context.Background(), input)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(ret, input) {
+		t.Errorf("unexpected transformed input: %v", ret)
+	}
+	if _, err := u.TransformInput(context.Background(), map[string]string{"image": "data:image/png;base64,%%%"}); !errors.Is(err, ErrInvalidDataURI) {
+		t.Errorf("expect invalid data uri error, got %v", err)
+	}
+	// prompts starting with data: are not data uris
+	for _, prompt := range []string{"data: cats, dogs and birds", "data: cats and dogs", "data:text,plain"} {
+		input := map[string]string{"prompt": prompt}
+		ret, err := u.TransformInput(context.Background(), input)
+		if err != nil {
+			t.Fatalf("%s: %v", prompt, err)
+		}
+		if !reflect.DeepEqual(ret, input) {
+			t.Errorf("expect prompt %q unchanged, got %v", prompt, ret)
+		}
+	}
+}
+
+func TestTransformInputJSONRules(t *testing.T) {
+	cdn := newFakeCDN(t)
+	u := cdn.uploader()
+	type Options struct {
+		Steps int `json:"steps,omitempty"`
+	}
+	type Input struct {
+		Image   []byte            `json:"image_url"`
+		Seed    int64             `json:"seed,string"`
+		Tags    []string          `json:"tags,omitempty"`
+		Extra   map[string]string `json:"extra,omitempty"`
+		Options Options           `json:"options,omitempty"`
+		Created time.Time         `json:"created,omitzero"`
+		Scale   float64           `json:"scale"`
+	}
+	input := Input{Image: []byte("hello"), Seed: 42, Tags: []string{}, Extra: map[string]string{}, Scale: 7.5}
+	ret, err := u.TransformInput(context.Background(), input)
+	if err != nil {
+		t.Fatal(err)
+	}
+	got, _ := json.Marshal(ret)
+	// the transformed input encodes like the input, except the uploaded fields
+	input.Image = nil
+	expect, _ := json.Marshal(input)
+	expect = bytes.Replace(expect, []byte(`"image_url":null`), []byte(`"image_url":"`+cdn.URL+`/files/upload.txt"`), 1)
+	var gotMap, expectMap map[string]any
+	json.Unmarshal(got, &gotMap)
+	json.Unmarshal(expect, &expectMap)
+	if !reflect.DeepEqual(gotMap, expectMap) {
+		t.Errorf("expect %s, got %s", expect, got)
+	}
+}
+
+func TestTransformInputSpill(t *testing.T) {
+	threshold := transformSpillThreshold
+	transformSpillThreshold = 16
+	t.Cleanup(func() { transformSpillThreshold = threshold })
+	tmp := t.TempDir()
+	t.Setenv("TMPDIR", tmp)
+	cdn := newFakeCDN(t)
+	u := cdn.uploader()
+	content := strings.Repeat("large text content ", 10)
+	input := map[string]any{"a": strings.NewReader(content), "b": strings.NewReader(content)}
+	ret, err := u.TransformInput(context.Background(), input)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := ret.(map[string]any); got["a"] != cdn.URL+"/files/upload.txt" || got["b"] != got["a"] {
+		t.Errorf("unexpected transformed input: %v", got)
+	}
+	// the buffered readers are deduplicated and uploaded in full
+	if cdn.uploads != 1 || string(cdn.files["upload.txt"]) != content {
+		t.Errorf("expect 1 upload of the content, got %d: %q", cdn.uploads, cdn.files["upload.txt"])
+	}
+	// the temp files buffering the large readers are removed
+	if entries, _ := os.ReadDir(tmp); len(entries) != 0 {
+		t.Errorf("expect temp files removed, got %d entries", len(entries))
+	}
+}
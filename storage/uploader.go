@@ -9,8 +9,12 @@ import (
 	"io"
 	"math"
 	"net/http"
+	"slices"
 	"strings"
 	"sync"
+	"time"
+
+	"github.com/bububa/falclient"
 )
 
 var (
@@ -40,24 +44,135 @@ func WithThreads(n int) Option {
 	}
 }
 
+// WithTransformThreads sets the number of concurrent uploads of TransformInput, default TransformMaxConcurrency
+func WithTransformThreads(n int) Option {
+	return func(u *Uploader) {
+		u.transformThreads = n
+	}
+}
+
+// WithMultipartThreshold sets the content size above which multipart upload is used, default MultipartThreshold
+func WithMultipartThreshold(size int64) Option {
+	return func(u *Uploader) {
+		u.multipartThreshold = size
+	}
+}
+
+// WithResumeStore persists the state of multipart uploads so that interrupted uploads can be resumed with Resume
+func WithResumeStore(store ResumeStore) Option {
+	return func(u *Uploader) {
+		u.resumeStore = store
+	}
+}
+
+// WithProgress reports the progress of uploads
+func WithProgress(fn ProgressFunc) Option {
+	return func(u *Uploader) {
+		u.progress = fn
+	}
+}
+
+// WithRateLimit limits the upload bandwidth of all the concurrent transfers to bytesPerSec
+func WithRateLimit(bytesPerSec int64) Option {
+	return func(u *Uploader) {
+		u.limiter = newRateLimiter(bytesPerSec)
+	}
+}
+
+// WithEndpoints overrides the fal.ai endpoints, empty fields fallback to defaults
+func WithEndpoints(v Endpoints) Option {
+	return func(u *Uploader) {
+		u.endpoints = v
+	}
+}
+
+// WithRetryPolicy sets the retry policy of http requests, default falclient.DefaultRetryPolicy
+func WithRetryPolicy(p falclient.RetryPolicy) Option {
+	return func(u *Uploader) {
+		u.retry = p
+	}
+}
+
+// WithUploadCache reuses the access url of a content uploaded less than ttl ago instead of uploading it again,
+// ttl <= 0 uses DefaultUploadCacheTTL
+func WithUploadCache(cache UploadCache, ttl time.Duration) Option {
+	return func(u *Uploader) {
+		u.cache = cache
+		u.cacheTTL = ttl
+	}
+}
+
+// WithCacheErrorHandler sets the handler of failed upload cache reads and writes, default ignores them.
+// The upload goes on without the cache
+func WithCacheErrorHandler(fn CacheErrorFunc) Option {
+	return func(u *Uploader) {
+		u.cacheErr = fn
+	}
+}
+
+// WithTokenRefreshSkew refreshes the cdn token d before its expiration, default DefaultTokenRefreshSkew
+func WithTokenRefreshSkew(d time.Duration) Option {
+	return func(u *Uploader) {
+		u.tokenManager.SetRefreshSkew(d)
+	}
+}
+
+// WithTokenRefreshTimeout bounds a cdn token refresh, default DefaultTokenRefreshTimeout
+func WithTokenRefreshTimeout(d time.Duration) Option {
+	return func(u *Uploader) {
+		u.tokenManager.SetRefreshTimeout(d)
+	}
+}
+
 type Uploader struct {
-	http         *http.Client
-	tokenManager *TokenManager
-	chunkSize    int64
-	threads      int
+	http               *http.Client
+	retry              falclient.RetryPolicy
+	tokenManager       *TokenManager
+	resumeStore        ResumeStore
+	cache              UploadCache
+	cacheTTL           time.Duration
+	cacheErr           CacheErrorFunc
+	progress           ProgressFunc
+	limiter            *rateLimiter
+	endpoints          Endpoints
+	multipartThreshold int64
+	chunkSize          int64
+	threads            int
+	transformThreads   int
 }
 
 func NewUploader(key string, store TokenStore, opts ...Option) *Uploader {
 	ret := &Uploader{
-		http:         http.DefaultClient,
-		tokenManager: NewTokenManager(key, store),
-		chunkSize:    MultipartChunkSize,
-		threads:      MultipartMaxConcurrency,
+		http:               http.DefaultClient,
+		retry:              falclient.DefaultRetryPolicy,
+		tokenManager:       NewTokenManager(key, store),
+		multipartThreshold: MultipartThreshold,
+		chunkSize:          MultipartChunkSize,
+		threads:            MultipartMaxConcurrency,
+		transformThreads:   TransformMaxConcurrency,
 	}
 	for _, opt := range opts {
 		opt(ret)
 	}
+	if ret.chunkSize <= 0 {
+		ret.chunkSize = MultipartChunkSize
+	}
+	if ret.threads <= 0 {
+		ret.threads = MultipartMaxConcurrency
+	}
+	if ret.transformThreads <= 0 {
+		ret.transformThreads = TransformMaxConcurrency
+	}
+	if ret.cacheTTL <= 0 {
+		ret.cacheTTL = DefaultUploadCacheTTL
+	}
+	if ret.cacheErr == nil {
+		ret.cacheErr = ignoreCacheError
+	}
+	ret.endpoints = ret.endpoints.withDefaults()
 	ret.tokenManager.SetHTTPClient(ret.http)
+	ret.tokenManager.SetRetryPolicy(ret.retry)
+	ret.tokenManager.SetEndpoints(ret.endpoints)
 	return ret
 }
 
@@ -78,7 +193,6 @@ func (u *Uploader) create(ctx context.Context, req *UploadRequest, resp *CreateU
 	if err != nil {
 		return errors.Join(ErrCreateUpload, err)
 	}
-	u.appendAuthHeader(httpReq, &token)
 	httpReq.Header.Set("Accept", "application/json")
 	contentType := req.ContentType
 	if contentType == "" {
@@ -94,16 +208,21 @@ func (u *Uploader) create(ctx context.Context, req *UploadRequest, resp *CreateU
 }
 
 func (u *Uploader) uploadPart(ctx context.Context, req *UploadPartRequest, ret *UploadPart) error {
-	var token Token
-	if err := u.tokenManager.Token(ctx, &token); err != nil {
-		return err
-	}
 	gw := fmt.Sprintf("%s/multipart/%s/%d", req.AccessURL, req.UploadID, req.PartNumber)
 	httpReq, err := http.NewRequestWithContext(ctx, http.MethodPut, gw, req.Reader)
 	if err != nil {
 		return errors.Join(ErrUploadPart, err)
 	}
-	u.appendAuthHeader(httpReq, &token)
+	if err := rewindable(httpReq, req.Reader); err != nil {
+		return errors.Join(ErrUploadPart, err)
+	}
+	if req.Size > 0 {
+		httpReq.ContentLength = req.Size
+	}
+	u.meter(httpReq, req.PartNumber, req.tracker)
+	if req.bodies != nil {
+		trackBodies(httpReq, req.bodies)
+	}
 	httpReq.Header.Set("Accept", "application/json")
 	contentType := req.ContentType
 	if contentType == "" {
@@ -111,14 +230,13 @@ func (u *Uploader) uploadPart(ctx context.Context, req *UploadPartRequest, ret *
 	}
 	httpReq.Header.Set("Content-Type", contentType)
 	httpReq.Header.Set("Accept-Encoding", "identity") // Keep this to ensure we get ETag headers
-	httpResp, err := u.http.Do(httpReq)
+	httpResp, err := u.send(httpReq)
 	if err != nil {
 		return errors.Join(ErrUploadPart, err)
 	}
 	defer httpResp.Body.Close()
-	if httpResp.StatusCode < 200 || httpResp.StatusCode >= 300 {
-		body, _ := io.ReadAll(httpResp.Body)
-		return fmt.Errorf("code: %d, body: %s", httpResp.StatusCode, string(body))
+	if !falclient.IsSuccess(httpResp.StatusCode) {
+		return errors.Join(ErrUploadPart, falclient.NewAPIError(httpResp))
 	}
 	etag := httpResp.Header.Get("ETag")
 	ret.PartNumber = req.PartNumber
@@ -127,10 +245,6 @@ func (u *Uploader) uploadPart(ctx context.Context, req *UploadPartRequest, ret *
 }
 
 func (u *Uploader) complete(ctx context.Context, req *CompleteUploadRequest) error {
-	var token Token
-	if err := u.tokenManager.Token(ctx, &token); err != nil {
-		return err
-	}
 	gw := fmt.Sprintf("%s/multipart/%s/complete", req.AccessURL, req.UploadID)
 	var buf bytes.Buffer
 	payload := struct {
@@ -143,7 +257,6 @@ func (u *Uploader) complete(ctx context.Context, req *CompleteUploadRequest) err
 	if err != nil {
 		return errors.Join(ErrUploadPart, err)
 	}
-	u.appendAuthHeader(httpReq, &token)
 	if err := u.fetch(httpReq, nil); err != nil {
 		return errors.Join(ErrUploadComplete, err)
 	}
@@ -151,114 +264,320 @@ func (u *Uploader) complete(ctx context.Context, req *CompleteUploadRequest) err
 }
 
 func (u *Uploader) uploadFile(ctx context.Context, req *UploadRequest) (string, error) {
-	httpReq, err := http.NewRequestWithContext(ctx, http.MethodPost, FileUploadURL, req.Reader)
+	httpReq, err := http.NewRequestWithContext(ctx, http.MethodPost, u.endpoints.FileUploadURL(), req.Reader)
 	if err != nil {
 		return "", errors.Join(ErrUploadFile, err)
 	}
-	var token Token
-	if err := u.tokenManager.Token(ctx, &token); err != nil {
-		return "", err
+	if err := rewindable(httpReq, req.Reader); err != nil {
+		return "", errors.Join(ErrUploadFile, err)
 	}
-	u.appendAuthHeader(httpReq, &token)
+	if req.Size > 0 {
+		httpReq.ContentLength = req.Size
+	}
+	u.meter(httpReq, 1, req.tracker)
 	httpReq.Header.Set("X-Fal-File-Name", req.Filename)
 	httpReq.Header.Set("Content-Type", req.ContentType)
-	httpResp, err := u.http.Do(httpReq)
+	httpResp, err := u.send(httpReq)
 	if err != nil {
 		return "", errors.Join(ErrUploadFile, err)
 	}
 	defer httpResp.Body.Close()
+	if !falclient.IsSuccess(httpResp.StatusCode) {
+		return "", errors.Join(ErrUploadFile, falclient.NewAPIError(httpResp))
+	}
 	var ret CreateUploadResult
 	if err := json.NewDecoder(httpResp.Body).Decode(&ret); err != nil {
 		return "", errors.Join(ErrUploadFile, err)
 	}
+	req.tracker.completePart(1, req.tracker.sentOf(1))
 	return ret.AccessURL, nil
 }
 
+// Upload uploads the content of req.Reader and returns its access url.
+// The content is streamed: readers implementing io.ReaderAt are uploaded by sections,
+// other readers are read chunk by chunk into at most WithThreads buffers of WithChunkSize bytes.
+// Contents of unknown size larger than a chunk are uploaded with multipart.
+// Missing filename and content type are inferred from the reader name, the filename extension and the content.
+// With WithUploadCache the access url of an already uploaded content is returned without uploading it again
 func (u *Uploader) Upload(ctx context.Context, req *UploadRequest) (string, error) {
-	if req.Filename == "" {
-		req.Filename = "upload.bin"
-	}
-	if req.ContentType == "" {
-		req.ContentType = "application/octet-stream"
+	if u.cache != nil {
+		return u.cachedUpload(ctx, req)
 	}
-	var buf bytes.Buffer
-	size, err := io.Copy(&buf, req.Reader)
-	if err != nil {
-		return "", err
+	return u.upload(ctx, req)
+}
+
+func (u *Uploader) upload(ctx context.Context, req *UploadRequest) (string, error) {
+	if req.Filename == "" || req.ContentType == "" {
+		if err := inferFileInfo(req); err != nil {
+			return "", err
+		}
 	}
-	if size <= MultipartThreshold {
+	size := contentSize(req.Reader, req.Size)
+	if size >= 0 && size <= u.multipartThreshold {
 		uploadReq := UploadRequest{
 			Filename:    req.Filename,
 			ContentType: req.ContentType,
-			Reader:      bytes.NewReader(buf.Bytes()),
+			Reader:      req.Reader,
+			Size:        size,
+			tracker:     newProgressTracker(u.progress, req.Filename, size, size),
 		}
 		return u.uploadFile(ctx, &uploadReq)
 	}
+	src := u.newChunkSource(req.Reader, size, u.chunkSize)
+	if size < 0 {
+		head, err := src.next()
+		if err != nil && !errors.Is(err, io.EOF) {
+			return "", err
+		}
+		if stream, ok := src.(*streamSource); ok && stream.eof {
+			// the whole content fits in the first chunk
+			uploadReq := UploadRequest{
+				Filename:    req.Filename,
+				ContentType: req.ContentType,
+				Reader:      bytes.NewReader(nil),
+			}
+			if head != nil {
+				defer head.release()
+				uploadReq.Reader = head.reader
+				uploadReq.Size = head.size
+			}
+			uploadReq.tracker = newProgressTracker(u.progress, req.Filename, uploadReq.Size, uploadReq.Size)
+			return u.uploadFile(ctx, &uploadReq)
+		}
+		src = &prependSource{head: head, src: src}
+	}
+	tracker := newProgressTracker(u.progress, req.Filename, size, u.chunkSize)
+	return u.multipart(ctx, req, src, size, tracker)
+}
+
+// multipart uploads the chunks of src with multipart upload, size is the content size or -1 if unknown
+func (u *Uploader) multipart(ctx context.Context, req *UploadRequest, src chunkSource, size int64, tracker *progressTracker) (string, error) {
 	var createResp CreateUploadResult
 	if err := u.create(ctx, req, &createResp); err != nil {
 		return "", err
 	}
-	chunks := int64(math.Ceil(float64(size) / float64(u.chunkSize)))
-	bs := buf.Bytes()
+	state := UploadState{
+		CreateUploadResult: createResp,
+		Filename:           req.Filename,
+		ContentType:        req.ContentType,
+		ChunkSize:          u.chunkSize,
+		Size:               max(size, 0),
+		UpdatedAt:          time.Now(),
+	}
+	if store := u.resumeStore; store != nil {
+		if err := store.Save(ctx, &state); err != nil {
+			return "", err
+		}
+	}
+	return u.uploadParts(ctx, &state, src, tracker)
+}
+
+// uploadParts uploads the chunks of src missing from the upload state and completes the upload.
+// The remaining parts are aborted on the first error and the upload is only completed when all parts succeed
+func (u *Uploader) uploadParts(ctx context.Context, state *UploadState, src chunkSource, tracker *progressTracker) (string, error) {
+	partCtx, cancel := context.WithCancelCause(ctx)
+	defer cancel(nil)
 	var (
 		semaphore = make(chan struct{}, u.threads)
 		wg        sync.WaitGroup
-		partErr   error
 		lock      = new(sync.Mutex)
-		parts     = make([]UploadPart, chunks)
+		parts     = make(map[int]PartState, len(state.Parts))
 	)
-	for idx := range chunks {
-		startPart := idx * u.chunkSize
-		endPart := min(startPart+u.chunkSize, size)
-		r := bytes.NewReader(bs[startPart:endPart])
+	for _, part := range state.Parts {
+		parts[part.PartNumber] = part
+	}
+	// last number of the last chunk read from src
+	var last int
+	for partCtx.Err() == nil {
+		select {
+		case semaphore <- struct{}{}:
+		case <-partCtx.Done():
+			continue
+		}
+		c, err := src.next()
+		if err != nil {
+			<-semaphore
+			if !errors.Is(err, io.EOF) {
+				cancel(err)
+			}
+			break
+		}
+		last = c.number
+		var hash string
+		lock.Lock()
+		recorded, ok := parts[c.number]
+		lock.Unlock()
+		if ok || u.resumeStore != nil {
+			if hash, err = chunkHash(c); err != nil {
+				c.release()
+				<-semaphore
+				cancel(err)
+				break
+			}
+		}
+		if ok && recorded.Size == c.size && recorded.SHA256 == hash {
+			tracker.completePart(c.number, c.size)
+			c.release()
+			<-semaphore
+			continue
+		}
 		partReq := UploadPartRequest{
-			CreateUploadResult: createResp,
-			ContentType:        req.ContentType,
-			PartNumber:         int(idx + 1),
-			Reader:             r,
+			CreateUploadResult: state.CreateUploadResult,
+			ContentType:        state.ContentType,
+			PartNumber:         c.number,
+			Reader:             c.reader,
+			Size:               c.size,
+			tracker:            tracker,
+			bodies:             new(sync.WaitGroup),
 		}
 		wg.Add(1)
-		semaphore <- struct{}{}
-		go func(partReq *UploadPartRequest) {
+		go func(partReq *UploadPartRequest, c *chunk, hash string) {
 			defer wg.Done()
 			defer func() { <-semaphore }()
+			// the transport may close the body after the response, the buffer is reused once every body is closed
+			defer func() {
+				go func() {
+					partReq.bodies.Wait()
+					c.release()
+				}()
+			}()
 			var partRet UploadPart
-			if err := u.uploadPart(ctx, partReq, &partRet); err != nil {
-				if partErr != nil {
-					partErr = err
-				} else {
-					partErr = errors.Join(partErr, err)
-				}
+			if err := u.uploadPart(partCtx, partReq, &partRet); err != nil {
+				cancel(err)
 				return
 			}
+			tracker.completePart(partRet.PartNumber, c.size)
 			lock.Lock()
-			parts = append(parts, partRet)
-			lock.Unlock()
-		}(&partReq)
+			defer lock.Unlock()
+			parts[partRet.PartNumber] = PartState{UploadPart: partRet, Size: c.size, SHA256: hash}
+			if store := u.resumeStore; store != nil {
+				state.Parts = sortedParts(parts)
+				state.UpdatedAt = time.Now()
+				if err := store.Save(partCtx, state); err != nil {
+					cancel(err)
+				}
+			}
+		}(&partReq, c, hash)
 	}
 	wg.Wait()
+	if err := context.Cause(partCtx); err != nil {
+		if u.resumeStore != nil {
+			return "", &ResumableError{UploadID: state.UploadID, Err: err}
+		}
+		return "", err
+	}
+	completed := sortedParts(parts)
+	// recorded parts past the end of the content belong to a different content
+	if n := len(completed); n > 0 && completed[n-1].PartNumber > last {
+		return "", fmt.Errorf("%w: content ends at part %d, part %d recorded", ErrUploadStateMismatch, last, completed[n-1].PartNumber)
+	}
 	completeReq := CompleteUploadRequest{
-		CreateUploadResult: createResp,
-		Parts:              parts,
+		CreateUploadResult: state.CreateUploadResult,
+		Parts:              make([]UploadPart, 0, len(completed)),
+	}
+	for idx, part := range completed {
+		if part.PartNumber != idx+1 {
+			return "", fmt.Errorf("%w: missing part %d", ErrUploadStateMismatch, idx+1)
+		}
+		completeReq.Parts = append(completeReq.Parts, part.UploadPart)
 	}
 	if err := u.complete(ctx, &completeReq); err != nil {
+		if u.resumeStore != nil {
+			return "", &ResumableError{UploadID: state.UploadID, Err: err}
+		}
 		return "", err
 	}
-	return createResp.AccessURL, nil
+	if store := u.resumeStore; store != nil {
+		if err := store.Delete(ctx, state.UploadID); err != nil {
+			return "", err
+		}
+	}
+	return state.AccessURL, nil
+}
+
+// sortedParts returns the parts sorted by part number
+func sortedParts(parts map[int]PartState) []PartState {
+	ret := make([]PartState, 0, len(parts))
+	for _, part := range parts {
+		ret = append(ret, part)
+	}
+	slices.SortFunc(ret, func(a, b PartState) int {
+		return a.PartNumber - b.PartNumber
+	})
+	return ret
 }
 
 func (u *Uploader) fetch(req *http.Request, resp any) error {
-	httpResp, err := u.http.Do(req)
+	httpResp, err := u.send(req)
 	if err != nil {
 		return err
 	}
 	defer httpResp.Body.Close()
-	if httpResp.StatusCode < 200 || httpResp.StatusCode >= 300 {
-		body, _ := io.ReadAll(httpResp.Body)
-		return fmt.Errorf("code: %d, body: %s", httpResp.StatusCode, string(body))
+	if !falclient.IsSuccess(httpResp.StatusCode) {
+		return falclient.NewAPIError(httpResp)
 	}
 	if resp != nil {
 		return json.NewDecoder(httpResp.Body).Decode(resp)
 	}
 	return nil
 }
+
+// send sends the request authorized with the cdn token. When the cdn rejects the token,
+// e.g. it expired mid-request, the token is invalidated and a replayable request is sent once more with a new token
+func (u *Uploader) send(req *http.Request) (*http.Response, error) {
+	ctx := req.Context()
+	var token Token
+	if err := u.tokenManager.Token(ctx, &token); err != nil {
+		// like http.Client.Do, the body is closed even on errors
+		if req.Body != nil {
+			req.Body.Close()
+		}
+		return nil, err
+	}
+	u.appendAuthHeader(req, &token)
+	httpResp, err := falclient.Do(ctx, u.http, req, u.retry)
+	if err != nil || httpResp.StatusCode != http.StatusUnauthorized {
+		return httpResp, err
+	}
+	if req.Body != nil && req.Body != http.NoBody && req.GetBody == nil {
+		return httpResp, nil
+	}
+	httpResp.Body.Close()
+	u.tokenManager.Invalidate(&token)
+	if err := u.tokenManager.Token(ctx, &token); err != nil {
+		return nil, err
+	}
+	retry := req.Clone(ctx)
+	if req.GetBody != nil {
+		if retry.Body, err = req.GetBody(); err != nil {
+			return nil, err
+		}
+	}
+	u.appendAuthHeader(retry, &token)
+	return falclient.Do(ctx, u.http, retry, u.retry)
+}
+
+// rewindable makes the request body replayable for retries when the reader supports io.ReaderAt and io.Seeker.
+// Every attempt reads a fresh section of the content, the transport may still read or close the body of the previous attempt
+func rewindable(req *http.Request, r io.Reader) error {
+	if req.GetBody != nil {
+		return nil
+	}
+	ra, ok := r.(io.ReaderAt)
+	if !ok {
+		return nil
+	}
+	seeker, ok := r.(io.Seeker)
+	if !ok {
+		return nil
+	}
+	offset, err := seeker.Seek(0, io.SeekCurrent)
+	if err != nil {
+		return err
+	}
+	req.GetBody = func() (io.ReadCloser, error) {
+		// the section ends where the content ends
+		return io.NopCloser(io.NewSectionReader(ra, offset, math.MaxInt64-offset)), nil
+	}
+	return nil
+}
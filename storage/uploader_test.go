@@ -1,9 +1,22 @@
 package storage
 
 import (
+	"bytes"
 	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
 	"os"
+	"strconv"
+	"strings"
+	"sync"
 	"testing"
+	"time"
+
+	"github.com/bububa/falclient"
 )
 
 func TestUploader(t *testing.T) {
@@ -27,3 +40,213 @@ func TestUploader(t *testing.T) {
 	}
 	t.Log(accessURL)
 }
+
+// fakeCDN fake fal token api and cdn
+type fakeCDN struct {
+	*httptest.Server
+	// failPart part number answered with an error
+	failPart int
+	lock     sync.Mutex
+	parts    map[int][]byte
+	files    map[string][]byte
+	uploads  int
+	tokens   int
+	puts     map[int]int
+	complete []UploadPart
+}
+
+func newFakeCDN(t *testing.T) *fakeCDN {
+	t.Helper()
+	cdn := &fakeCDN{
+		parts: make(map[int][]byte),
+		files: make(map[string][]byte),
+		puts:  make(map[int]int),
+	}
+	mux := http.NewServeMux()
+	mux.HandleFunc("POST /storage/auth/token", func(w http.ResponseWriter, r *http.Request) {
+		cdn.lock.Lock()
+		cdn.tokens++
+		cdn.lock.Unlock()
+		json.NewEncoder(w).Encode(Token{
+			Token:     "cdn-token",
+			TokenType: "Bearer",
+			BaseURL:   cdn.URL,
+			CreatedAt: TokenTime(time.Now()),
+			ExpireAt:  TokenTime(time.Now().Add(time.Hour)),
+		})
+	})
+	mux.HandleFunc("POST /files/upload", func(w http.ResponseWriter, r *http.Request) {
+		body, _ := io.ReadAll(r.Body)
+		name := r.Header.Get("X-Fal-File-Name")
+		cdn.lock.Lock()
+		cdn.files[name] = body
+		cdn.uploads++
+		cdn.lock.Unlock()
+		json.NewEncoder(w).Encode(CreateUploadResult{AccessURL: cdn.URL + "/files/" + name})
+	})
+	mux.HandleFunc("POST /files/upload/multipart", func(w http.ResponseWriter, r *http.Request) {
+		json.NewEncoder(w).Encode(CreateUploadResult{AccessURL: cdn.URL + "/files/multipart.bin", UploadID: "upload-1"})
+	})
+	mux.HandleFunc("PUT /files/multipart.bin/multipart/upload-1/{part}", func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("Authorization") != "Bearer cdn-token" {
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+		part, _ := strconv.Atoi(r.PathValue("part"))
+		body, _ := io.ReadAll(r.Body)
+		cdn.lock.Lock()
+		cdn.puts[part]++
+		cdn.lock.Unlock()
+		if part == cdn.failPart {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		cdn.lock.Lock()
+		cdn.parts[part] = body
+		cdn.lock.Unlock()
+		w.Header().Set("ETag", fmt.Sprintf("etag-%d", part))
+	})
+	mux.HandleFunc("POST /files/multipart.bin/multipart/upload-1/complete", func(w http.ResponseWriter, r *http.Request) {
+		var payload struct {
+			Parts []UploadPart `json:"parts"`
+		}
+		json.NewDecoder(r.Body).Decode(&payload)
+		cdn.lock.Lock()
+		cdn.complete = payload.Parts
+		cdn.lock.Unlock()
+	})
+	cdn.Server = httptest.NewServer(mux)
+	t.Cleanup(cdn.Close)
+	return cdn
+}
+
+// assembled returns the multipart content in the order of the complete request
+func (c *fakeCDN) assembled() []byte {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	var buf bytes.Buffer
+	for _, part := range c.complete {
+		buf.Write(c.parts[part.PartNumber])
+	}
+	return buf.Bytes()
+}
+
+func (c *fakeCDN) uploader(opts ...Option) *Uploader {
+	opts = append([]Option{
+		WithEndpoints(Endpoints{Rest: c.URL, CDN: c.URL}),
+		WithRetryPolicy(falclient.NoRetry),
+	}, opts...)
+	return NewUploader("key", new(MemoryTokenStore), opts...)
+}
+
+func TestMultipartUpload(t *testing.T) {
+	content := bytes.Repeat([]byte("0123456789abcdef"), 1000)
+	tests := []struct {
+		name   string
+		reader func() io.Reader
+	}{
+		{name: "reader at", reader: func() io.Reader { return bytes.NewReader(content) }},
+		{name: "stream", reader: func() io.Reader { return io.MultiReader(bytes.NewReader(content)) }},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			cdn := newFakeCDN(t)
+			u := cdn.uploader(WithChunkSize(1000), WithThreads(4), WithMultipartThreshold(1000))
+			accessURL, err := u.Upload(context.Background(), &UploadRequest{Filename: "multipart.bin", Reader: tt.reader()})
+			if err != nil {
+				t.Fatal(err)
+			}
+			if accessURL != cdn.URL+"/files/multipart.bin" {
+				t.Errorf("unexpected access url: %s", accessURL)
+			}
+			if len(cdn.complete) != 16 {
+				t.Fatalf("expect 16 parts, got %d", len(cdn.complete))
+			}
+			for idx, part := range cdn.complete {
+				if part.PartNumber != idx+1 || part.ETag != fmt.Sprintf("etag-%d", idx+1) {
+					t.Errorf("unexpected part at %d: %+v", idx, part)
+				}
+			}
+			if !bytes.Equal(cdn.assembled(), content) {
+				t.Error("assembled content mismatch")
+			}
+		})
+	}
+}
+
+func TestMultipartUploadFailure(t *testing.T) {
+	cdn := newFakeCDN(t)
+	cdn.failPart = 3
+	u := cdn.uploader(WithChunkSize(1000), WithThreads(4), WithMultipartThreshold(1000))
+	content := bytes.Repeat([]byte{'x'}, 20000)
+	_, err := u.Upload(context.Background(), &UploadRequest{Reader: bytes.NewReader(content)})
+	if !errors.Is(err, ErrUploadPart) {
+		t.Fatalf("expect upload part error, got %v", err)
+	}
+	if !errors.As(err, new(*falclient.APIError)) {
+		t.Errorf("expect api error, got %v", err)
+	}
+	if cdn.complete != nil {
+		t.Error("complete should not be called after a part failure")
+	}
+}
+
+func TestUploadUnauthorizedRetry(t *testing.T) {
+	ctx := context.Background()
+	cdn := newFakeCDN(t)
+	store := new(MemoryTokenStore)
+	// the stored token was revoked by the cdn before its expiration
+	store.Set(ctx, &Token{Token: "revoked", TokenType: "Bearer", BaseURL: cdn.URL, ExpireAt: TokenTime(time.Now().Add(time.Hour))})
+	u := NewUploader("key", store, WithEndpoints(Endpoints{Rest: cdn.URL, CDN: cdn.URL}), WithRetryPolicy(falclient.NoRetry),
+		WithChunkSize(1000), WithThreads(4), WithMultipartThreshold(1000))
+	content := bytes.Repeat([]byte{'x'}, 5000)
+	if _, err := u.Upload(ctx, &UploadRequest{Reader: bytes.NewReader(content)}); err != nil {
+		t.Fatal(err)
+	}
+	if cdn.tokens != 1 {
+		t.Errorf("expect 1 token refresh, got %d", cdn.tokens)
+	}
+	if !bytes.Equal(cdn.assembled(), content) {
+		t.Error("assembled content mismatch")
+	}
+}
+
+func TestSingleUpload(t *testing.T) {
+	cdn := newFakeCDN(t)
+	u := cdn.uploader()
+	accessURL, err := u.Upload(context.Background(), &UploadRequest{Filename: "small.txt", Reader: strings.NewReader("hello")})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if accessURL != cdn.URL+"/files/small.txt" {
+		t.Errorf("unexpected access url: %s", accessURL)
+	}
+	if string(cdn.files["small.txt"]) != "hello" {
+		t.Errorf("unexpected content: %s", cdn.files["small.txt"])
+	}
+}
+
+func TestRewindable(t *testing.T) {
+	f, err := os.CreateTemp(t.TempDir(), "content")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	f.WriteString("skip:content")
+	f.Seek(5, io.SeekStart)
+	req, _ := http.NewRequest(http.MethodPut, "http://cdn", f)
+	if err := rewindable(req, f); err != nil {
+		t.Fatal(err)
+	}
+	// the bodies of two attempts do not share their offset
+	first, _ := req.GetBody()
+	second, _ := req.GetBody()
+	head := make([]byte, 3)
+	io.ReadFull(first, head)
+	if rest, _ := io.ReadAll(second); string(rest) != "content" {
+		t.Errorf("unexpected second body: %s", rest)
+	}
+	if rest, _ := io.ReadAll(first); string(head)+string(rest) != "content" {
+		t.Errorf("unexpected first body: %s%s", head, rest)
+	}
+}
@@ -1,5 +1,20 @@
 package webhook
 
+import "time"
+
 const (
 	JWSKEndpoint = "https://rest.alpha.fal.ai/.well-known/jwks.json"
 )
+
+const (
+	HeaderRequestID = "X-Fal-Webhook-Request-Id"
+	HeaderUserID    = "X-Fal-Webhook-User-Id"
+	HeaderTimestamp = "X-Fal-Webhook-Timestamp"
+	HeaderSignature = "X-Fal-Webhook-Signature"
+)
+
+// Tolerance max allowed difference between the webhook timestamp and now
+const Tolerance = 300 * time.Second
+
+// DefaultMaxBodySize default max size of a webhook request body
+const DefaultMaxBodySize = 10 << 20
@@ -0,0 +1,258 @@
+package webhook
+
+import (
+	"bufio"
+	"bytes"
+	"container/list"
+	"context"
+	"encoding/json"
+	"errors"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+)
+
+var (
+	// ErrReplayedDelivery the exact same signed delivery was already received
+	ErrReplayedDelivery = errors.New("replayed delivery")
+	// ErrDuplicateDelivery the request was already delivered
+	ErrDuplicateDelivery = errors.New("duplicate delivery")
+	// ErrDeliveryInProgress the request is being handled by a concurrent delivery
+	ErrDeliveryInProgress = errors.New("delivery in progress")
+)
+
+// DefaultDeliveryTTL default duration a delivered request id is remembered
+const DefaultDeliveryTTL = 24 * time.Hour
+
+// DuplicatePolicy how the verifier handles a request id delivered more than once
+type DuplicatePolicy int
+
+const (
+	// DuplicateReject Verify returns ErrDuplicateDelivery
+	DuplicateReject DuplicatePolicy = iota
+	// DuplicateFlag Verify succeeds with Request.Duplicate set
+	DuplicateFlag
+)
+
+// DeliveryStore records seen webhook deliveries
+type DeliveryStore interface {
+	// Add records the key until ttl elapses, reports whether the key was already recorded
+	Add(ctx context.Context, key string, ttl time.Duration) (bool, error)
+	// Remove forgets the key
+	Remove(ctx context.Context, key string) error
+}
+
+func signatureKey(signature string) string {
+	return "sig:" + signature
+}
+
+func requestKey(requestID string) string {
+	return "req:" + requestID
+}
+
+type deliveryEntry struct {
+	key      string
+	expireAt time.Time
+}
+
+// MemoryDeliveryStore in-memory LRU DeliveryStore
+type MemoryDeliveryStore struct {
+	capacity int
+	items    map[string]*list.Element
+	lru      *list.List
+	lock     sync.Mutex
+}
+
+// NewMemoryDeliveryStore creates a MemoryDeliveryStore keeping at most capacity keys
+func NewMemoryDeliveryStore(capacity int) *MemoryDeliveryStore {
+	return &MemoryDeliveryStore{
+		capacity: capacity,
+		items:    make(map[string]*list.Element),
+		lru:      list.New(),
+	}
+}
+
+func (s *MemoryDeliveryStore) Add(_ context.Context, key string, ttl time.Duration) (bool, error) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	now := time.Now()
+	if el, ok := s.items[key]; ok {
+		entry := el.Value.(*deliveryEntry)
+		if entry.expireAt.After(now) {
+			s.lru.MoveToFront(el)
+			return true, nil
+		}
+		entry.expireAt = now.Add(ttl)
+		s.lru.MoveToFront(el)
+		return false, nil
+	}
+	s.items[key] = s.lru.PushFront(&deliveryEntry{key: key, expireAt: now.Add(ttl)})
+	for s.capacity > 0 && s.lru.Len() > s.capacity {
+		el := s.lru.Back()
+		s.lru.Remove(el)
+		delete(s.items, el.Value.(*deliveryEntry).key)
+	}
+	return false, nil
+}
+
+func (s *MemoryDeliveryStore) Remove(_ context.Context, key string) error {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	if el, ok := s.items[key]; ok {
+		s.lru.Remove(el)
+		delete(s.items, key)
+	}
+	return nil
+}
+
+// fileCompactThreshold min number of records in the file before it is compacted
+const fileCompactThreshold = 1024
+
+// deliveryRecord line of the FileDeliveryStore file, a zero expiration removes the key
+type deliveryRecord struct {
+	Key      string    `json:"key"`
+	ExpireAt time.Time `json:"expires_at,omitzero"`
+}
+
+// FileDeliveryStore DeliveryStore persisted as an append-only json lines file, suitable for single instance deployments.
+// Every change appends a record, the file is rewritten without the stale records once it doubled since the last rewrite
+type FileDeliveryStore struct {
+	path    string
+	file    *os.File
+	items   map[string]time.Time
+	records int
+	// live records of the file after the last compaction
+	compacted int
+	lock      sync.Mutex
+}
+
+// NewFileDeliveryStore opens the store at path, the file is created on first write
+func NewFileDeliveryStore(path string) (*FileDeliveryStore, error) {
+	ret := &FileDeliveryStore{
+		path:  path,
+		items: make(map[string]time.Time),
+	}
+	fp, err := os.Open(path)
+	if err != nil {
+		if errors.Is(err, os.ErrNotExist) {
+			return ret, nil
+		}
+		return nil, err
+	}
+	defer fp.Close()
+	scanner := bufio.NewScanner(fp)
+	for scanner.Scan() {
+		var record deliveryRecord
+		// a torn record of an interrupted write is skipped
+		if err := json.Unmarshal(scanner.Bytes(), &record); err != nil || record.Key == "" {
+			continue
+		}
+		ret.records++
+		if record.ExpireAt.IsZero() {
+			delete(ret.items, record.Key)
+		} else {
+			ret.items[record.Key] = record.ExpireAt
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+	ret.compacted = len(ret.items)
+	return ret, nil
+}
+
+func (s *FileDeliveryStore) Add(_ context.Context, key string, ttl time.Duration) (bool, error) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	now := time.Now()
+	if expireAt, ok := s.items[key]; ok && expireAt.After(now) {
+		return true, nil
+	}
+	expireAt := now.Add(ttl)
+	s.items[key] = expireAt
+	return false, s.append(deliveryRecord{Key: key, ExpireAt: expireAt})
+}
+
+func (s *FileDeliveryStore) Remove(_ context.Context, key string) error {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	if _, ok := s.items[key]; !ok {
+		return nil
+	}
+	delete(s.items, key)
+	return s.append(deliveryRecord{Key: key})
+}
+
+// Close closes the store file
+func (s *FileDeliveryStore) Close() error {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	if s.file == nil {
+		return nil
+	}
+	err := s.file.Close()
+	s.file = nil
+	return err
+}
+
+// append writes the record at the end of the file, compacting the file when it holds too many stale records
+func (s *FileDeliveryStore) append(record deliveryRecord) error {
+	if s.records >= fileCompactThreshold && s.records >= 2*s.compacted {
+		return s.compact()
+	}
+	if s.file == nil {
+		fp, err := os.OpenFile(s.path, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0o600)
+		if err != nil {
+			return err
+		}
+		s.file = fp
+	}
+	bs, err := json.Marshal(record)
+	if err != nil {
+		return err
+	}
+	if _, err := s.file.Write(append(bs, '\n')); err != nil {
+		return err
+	}
+	s.records++
+	return nil
+}
+
+// compact drops the expired items and rewrites the live ones to a temp file renamed over the store file
+func (s *FileDeliveryStore) compact() error {
+	now := time.Now()
+	var buf bytes.Buffer
+	enc := json.NewEncoder(&buf)
+	for key, expireAt := range s.items {
+		if !expireAt.After(now) {
+			delete(s.items, key)
+			continue
+		}
+		if err := enc.Encode(deliveryRecord{Key: key, ExpireAt: expireAt}); err != nil {
+			return err
+		}
+	}
+	fp, err := os.CreateTemp(filepath.Dir(s.path), filepath.Base(s.path)+".*.tmp")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(fp.Name())
+	if _, err := fp.Write(buf.Bytes()); err != nil {
+		fp.Close()
+		return err
+	}
+	if err := fp.Close(); err != nil {
+		return err
+	}
+	if err := os.Rename(fp.Name(), s.path); err != nil {
+		return err
+	}
+	if s.file != nil {
+		s.file.Close()
+		s.file = nil
+	}
+	s.records = len(s.items)
+	s.compacted = s.records
+	return nil
+}
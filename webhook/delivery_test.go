@@ -0,0 +1,260 @@
+package webhook
+
+import (
+	"bytes"
+	"context"
+	"crypto/ed25519"
+	"crypto/rand"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestDeliveryStore(t *testing.T) {
+	ctx := context.Background()
+	fileStore, err := NewFileDeliveryStore(filepath.Join(t.TempDir(), "deliveries.json"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	stores := map[string]DeliveryStore{
+		"memory": NewMemoryDeliveryStore(2),
+		"file":   fileStore,
+	}
+	for name, store := range stores {
+		t.Run(name, func(t *testing.T) {
+			if seen, _ := store.Add(ctx, "a", time.Hour); seen {
+				t.Error("a should not be seen")
+			}
+			if seen, _ := store.Add(ctx, "a", time.Hour); !seen {
+				t.Error("a should be seen")
+			}
+			if seen, _ := store.Add(ctx, "expired", -time.Second); seen {
+				t.Error("expired should not be seen")
+			}
+			if seen, _ := store.Add(ctx, "expired", time.Hour); seen {
+				t.Error("expired key should be accepted again")
+			}
+			store.Remove(ctx, "a")
+			if seen, _ := store.Add(ctx, "a", time.Hour); seen {
+				t.Error("removed key should not be seen")
+			}
+		})
+	}
+
+	t.Run("lru eviction", func(t *testing.T) {
+		store := NewMemoryDeliveryStore(2)
+		store.Add(ctx, "a", time.Hour)
+		store.Add(ctx, "b", time.Hour)
+		store.Add(ctx, "a", time.Hour)
+		store.Add(ctx, "c", time.Hour)
+		if seen, _ := store.Add(ctx, "b", time.Hour); seen {
+			t.Error("b should be evicted")
+		}
+	})
+
+	t.Run("file reopen", func(t *testing.T) {
+		path := filepath.Join(t.TempDir(), "deliveries.json")
+		store, _ := NewFileDeliveryStore(path)
+		store.Add(ctx, "a", time.Hour)
+		reopened, err := NewFileDeliveryStore(path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if seen, _ := reopened.Add(ctx, "a", time.Hour); !seen {
+			t.Error("a should be persisted")
+		}
+	})
+}
+
+func TestVerifyDelivery(t *testing.T) {
+	pub, priv, _ := ed25519.GenerateKey(rand.Reader)
+	srv := newJWKSServer(t, pub)
+	defer srv.Close()
+	const body = `{"request_id":"req-1","status":"OK"}`
+	send := func(v *Verifier, ts time.Time) (*Request, error) {
+		var req Request
+		err := v.Verify(context.Background(), newSignedRequest(priv, "req-1", ts, body), &req)
+		return &req, err
+	}
+
+	t.Run("reject", func(t *testing.T) {
+		v := NewVerifier(WithJWKSEndpoint(srv.URL), WithDeliveryStore(NewMemoryDeliveryStore(100)))
+		now := time.Now()
+		if _, err := send(v, now); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := send(v, now); !errors.Is(err, ErrReplayedDelivery) {
+			t.Errorf("expect replayed delivery, got %v", err)
+		}
+		if _, err := send(v, now.Add(time.Second)); !errors.Is(err, ErrDuplicateDelivery) {
+			t.Errorf("expect duplicate delivery, got %v", err)
+		}
+	})
+
+	t.Run("flag", func(t *testing.T) {
+		v := NewVerifier(WithJWKSEndpoint(srv.URL), WithDeliveryStore(NewMemoryDeliveryStore(100)), WithDuplicatePolicy(DuplicateFlag))
+		now := time.Now()
+		if req, err := send(v, now); err != nil || req.Duplicate {
+			t.Fatalf("unexpected first delivery: %v", err)
+		}
+		req, err := send(v, now.Add(time.Second))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !req.Duplicate {
+			t.Error("expect duplicate flag")
+		}
+	})
+
+	t.Run("forget", func(t *testing.T) {
+		v := NewVerifier(WithJWKSEndpoint(srv.URL), WithDeliveryStore(NewMemoryDeliveryStore(100)))
+		httpReq := newSignedRequest(priv, "req-1", time.Now(), body)
+		var req Request
+		if err := v.Verify(context.Background(), httpReq, &req); err != nil {
+			t.Fatal(err)
+		}
+		v.Forget(context.Background(), httpReq)
+		if _, err := send(v, time.Now().Add(time.Second)); err != nil {
+			t.Errorf("expect redelivery accepted, got %v", err)
+		}
+	})
+
+	t.Run("handler acknowledges duplicates", func(t *testing.T) {
+		v := NewVerifier(WithJWKSEndpoint(srv.URL), WithDeliveryStore(NewMemoryDeliveryStore(100)))
+		var calls int
+		h := NewHandler(WithVerifier[struct{}](v), OnSuccess(func(ctx context.Context, req *Request, payload *struct{}) error {
+			calls++
+			return nil
+		}))
+		now := time.Now()
+		for i, code := range []int{http.StatusOK, http.StatusOK} {
+			w := httptest.NewRecorder()
+			h.ServeHTTP(w, newSignedRequest(priv, "req-1", now.Add(time.Duration(i)*time.Second), body))
+			if w.Code != code {
+				t.Errorf("delivery %d: expect %d, got %d", i, code, w.Code)
+			}
+		}
+		if calls != 1 {
+			t.Errorf("expect 1 call, got %d", calls)
+		}
+	})
+	t.Run("handler retries concurrent deliveries", func(t *testing.T) {
+		v := NewVerifier(WithJWKSEndpoint(srv.URL), WithDeliveryStore(NewMemoryDeliveryStore(100)))
+		var (
+			calls    int
+			started  = make(chan struct{})
+			release  = make(chan struct{})
+			lastCall = errors.New("database unavailable")
+		)
+		h := NewHandler(WithVerifier[struct{}](v), OnSuccess(func(ctx context.Context, req *Request, payload *struct{}) error {
+			calls++
+			if calls == 1 {
+				close(started)
+				<-release
+				return lastCall
+			}
+			return nil
+		}))
+		now := time.Now()
+		first := httptest.NewRecorder()
+		done := make(chan struct{})
+		go func() {
+			defer close(done)
+			h.ServeHTTP(first, newSignedRequest(priv, "req-1", now, body))
+		}()
+		<-started
+		// the first attempt is still running, the redelivery must not be acknowledged
+		w := httptest.NewRecorder()
+		h.ServeHTTP(w, newSignedRequest(priv, "req-1", now.Add(time.Second), body))
+		if w.Code != http.StatusServiceUnavailable {
+			t.Errorf("expect %d while in progress, got %d", http.StatusServiceUnavailable, w.Code)
+		}
+		close(release)
+		<-done
+		if first.Code != http.StatusInternalServerError {
+			t.Errorf("expect first attempt to fail, got %d", first.Code)
+		}
+		w = httptest.NewRecorder()
+		h.ServeHTTP(w, newSignedRequest(priv, "req-1", now.Add(2*time.Second), body))
+		if w.Code != http.StatusOK || calls != 2 {
+			t.Errorf("expect the redelivery handled, got %d with %d calls", w.Code, calls)
+		}
+	})
+
+	t.Run("middleware forgets failed deliveries", func(t *testing.T) {
+		v := NewVerifier(WithJWKSEndpoint(srv.URL), WithDeliveryStore(NewMemoryDeliveryStore(100)))
+		var calls int
+		h := Middleware(v)(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			calls++
+			if calls == 1 {
+				http.Error(w, "try later", http.StatusInternalServerError)
+			}
+		}))
+		now := time.Now()
+		for i, code := range []int{http.StatusInternalServerError, http.StatusOK, http.StatusOK} {
+			w := httptest.NewRecorder()
+			h.ServeHTTP(w, newSignedRequest(priv, "req-1", now.Add(time.Duration(i)*time.Second), body))
+			if w.Code != code {
+				t.Errorf("delivery %d: expect %d, got %d", i, code, w.Code)
+			}
+		}
+		if calls != 2 {
+			t.Errorf("expect 2 calls, got %d", calls)
+		}
+	})
+
+	t.Run("middleware acknowledges duplicates", func(t *testing.T) {
+		v := NewVerifier(WithJWKSEndpoint(srv.URL), WithDeliveryStore(NewMemoryDeliveryStore(100)))
+		var calls int
+		h := Middleware(v)(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			calls++
+		}))
+		now := time.Now()
+		for i := range 3 {
+			w := httptest.NewRecorder()
+			h.ServeHTTP(w, newSignedRequest(priv, "req-1", now.Add(time.Duration(i)*time.Second), body))
+			if w.Code != http.StatusOK {
+				t.Errorf("delivery %d: expect %d, got %d", i, http.StatusOK, w.Code)
+			}
+		}
+		if calls != 1 {
+			t.Errorf("expect 1 call, got %d", calls)
+		}
+	})
+}
+
+func TestFileDeliveryStoreCompaction(t *testing.T) {
+	ctx := context.Background()
+	path := filepath.Join(t.TempDir(), "deliveries.jsonl")
+	store, err := NewFileDeliveryStore(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	store.Add(ctx, "live", time.Hour)
+	for i := range 2 * fileCompactThreshold {
+		if _, err := store.Add(ctx, fmt.Sprintf("expired-%d", i), -time.Second); err != nil {
+			t.Fatal(err)
+		}
+	}
+	store.Close()
+	bs, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if lines := bytes.Count(bs, []byte("\n")); lines > fileCompactThreshold+1 {
+		t.Errorf("expect the file compacted, got %d records", lines)
+	}
+	reopened, err := NewFileDeliveryStore(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer reopened.Close()
+	if seen, _ := reopened.Add(ctx, "live", time.Hour); !seen {
+		t.Error("live should survive the compaction")
+	}
+}
@@ -0,0 +1,274 @@
+package webhook
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"sync"
+)
+
+// ErrInvalidPayload the payload can not be decoded into the handler type
+var ErrInvalidPayload = errors.New("invalid payload")
+
+// DefaultEndpointParam query parameter of the webhook url carrying the endpoint
+const DefaultEndpointParam = "endpoint"
+
+// SuccessFunc handles a successful delivery with the decoded payload
+type SuccessFunc[T any] func(ctx context.Context, req *Request, payload *T) error
+
+// ErrorFunc handles an error delivery
+type ErrorFunc func(ctx context.Context, req *Request) error
+
+type callbacks[T any] struct {
+	onSuccess SuccessFunc[T]
+	onError   ErrorFunc
+}
+
+type HandlerOption[T any] func(*Handler[T])
+
+// WithVerifier sets the verifier, default verifier is used if not set
+func WithVerifier[T any](v *Verifier) HandlerOption[T] {
+	return func(h *Handler[T]) {
+		h.verifier = v
+	}
+}
+
+// WithEndpointParam sets the query parameter of the webhook url carrying the endpoint, default DefaultEndpointParam
+func WithEndpointParam[T any](name string) HandlerOption[T] {
+	return func(h *Handler[T]) {
+		h.endpointParam = name
+	}
+}
+
+// OnSuccess sets the default success callback
+func OnSuccess[T any](fn SuccessFunc[T]) HandlerOption[T] {
+	return func(h *Handler[T]) {
+		h.fallback.onSuccess = fn
+	}
+}
+
+// OnError sets the default error callback
+func OnError[T any](fn ErrorFunc) HandlerOption[T] {
+	return func(h *Handler[T]) {
+		h.fallback.onError = fn
+	}
+}
+
+// OnEndpointSuccess sets the success callback of an endpoint
+func OnEndpointSuccess[T any](endpoint string, fn SuccessFunc[T]) HandlerOption[T] {
+	return func(h *Handler[T]) {
+		cb := h.endpoints[endpoint]
+		cb.onSuccess = fn
+		h.endpoints[endpoint] = cb
+	}
+}
+
+// OnEndpointError sets the error callback of an endpoint
+func OnEndpointError[T any](endpoint string, fn ErrorFunc) HandlerOption[T] {
+	return func(h *Handler[T]) {
+		cb := h.endpoints[endpoint]
+		cb.onError = fn
+		h.endpoints[endpoint] = cb
+	}
+}
+
+// Handler http.Handler verifying fal webhook deliveries and dispatching them to callbacks.
+// Callbacks are looked up by request id, then by endpoint, then the default ones
+type Handler[T any] struct {
+	verifier      *Verifier
+	endpointParam string
+	fallback      callbacks[T]
+	endpoints     map[string]callbacks[T]
+	requests      map[string]callbacks[T]
+	lock          sync.RWMutex
+}
+
+func NewHandler[T any](opts ...HandlerOption[T]) *Handler[T] {
+	ret := &Handler[T]{
+		endpointParam: DefaultEndpointParam,
+		endpoints:     make(map[string]callbacks[T]),
+		requests:      make(map[string]callbacks[T]),
+	}
+	for _, opt := range opts {
+		opt(ret)
+	}
+	if ret.verifier == nil {
+		ret.verifier = defaultVerifier
+	}
+	return ret
+}
+
+// HandleRequest registers one-shot callbacks of a request, they are removed once the delivery is handled
+func (h *Handler[T]) HandleRequest(requestID string, onSuccess SuccessFunc[T], onError ErrorFunc) {
+	h.lock.Lock()
+	defer h.lock.Unlock()
+	h.requests[requestID] = callbacks[T]{onSuccess: onSuccess, onError: onError}
+}
+
+func (h *Handler[T]) lookup(requestID string, endpoint string) (callbacks[T], bool) {
+	h.lock.RLock()
+	defer h.lock.RUnlock()
+	if cb, ok := h.requests[requestID]; ok {
+		return cb, true
+	}
+	if cb, ok := h.endpoints[endpoint]; ok {
+		return cb, false
+	}
+	return h.fallback, false
+}
+
+func (h *Handler[T]) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, http.StatusText(http.StatusMethodNotAllowed), http.StatusMethodNotAllowed)
+		return
+	}
+	ctx := r.Context()
+	var req Request
+	if err := h.verifier.begin(ctx, r, &req); err != nil {
+		// already handled, acknowledge so that fal stops retrying
+		if errors.Is(err, ErrDuplicateDelivery) {
+			w.WriteHeader(http.StatusOK)
+			return
+		}
+		http.Error(w, err.Error(), verifyErrorStatus(err))
+		return
+	}
+	cb, oneShot := h.lookup(req.RequestID, r.URL.Query().Get(h.endpointParam))
+	dispatched := false
+	defer func() {
+		// a panicking callback leaves the delivery to a redelivery
+		if !dispatched {
+			h.verifier.Forget(context.WithoutCancel(ctx), r)
+		}
+	}()
+	err := h.dispatch(ctx, cb, &req)
+	dispatched = true
+	if err != nil {
+		h.verifier.Forget(context.WithoutCancel(ctx), r)
+		if errors.Is(err, ErrInvalidPayload) {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		// let fal retry the delivery
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	h.verifier.finish(r)
+	if oneShot {
+		h.lock.Lock()
+		delete(h.requests, req.RequestID)
+		h.lock.Unlock()
+	}
+	w.WriteHeader(http.StatusOK)
+}
+
+func (h *Handler[T]) dispatch(ctx context.Context, cb callbacks[T], req *Request) error {
+	if req.IsError() {
+		if cb.onError != nil {
+			return cb.onError(ctx, req)
+		}
+		return nil
+	}
+	if cb.onSuccess == nil {
+		return nil
+	}
+	payload := new(T)
+	if len(req.Payload) > 0 {
+		if err := json.Unmarshal(req.Payload, payload); err != nil {
+			return errors.Join(ErrInvalidPayload, err)
+		}
+	}
+	return cb.onSuccess(ctx, req, payload)
+}
+
+type requestContextKey struct{}
+
+// RequestFromContext returns the verified webhook request stored by Middleware
+func RequestFromContext(ctx context.Context) (*Request, bool) {
+	req, ok := ctx.Value(requestContextKey{}).(*Request)
+	return req, ok
+}
+
+// statusRecorder records the status code written by a handler
+type statusRecorder struct {
+	http.ResponseWriter
+	status int
+}
+
+func (w *statusRecorder) WriteHeader(code int) {
+	if w.status == 0 {
+		w.status = code
+	}
+	w.ResponseWriter.WriteHeader(code)
+}
+
+func (w *statusRecorder) Write(b []byte) (int, error) {
+	if w.status == 0 {
+		w.status = http.StatusOK
+	}
+	return w.ResponseWriter.Write(b)
+}
+
+func (w *statusRecorder) Unwrap() http.ResponseWriter {
+	return w.ResponseWriter
+}
+
+// Middleware verifies webhook requests before calling next, the decoded request is available with RequestFromContext.
+// The delivery is forgotten when next responds with an error status or panics, so that fal can redeliver it,
+// a duplicate of a handled delivery is acknowledged without calling next.
+// The default verifier is used if v is nil
+func Middleware(v *Verifier) func(http.Handler) http.Handler {
+	if v == nil {
+		v = defaultVerifier
+	}
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			var req Request
+			if err := v.begin(r.Context(), r, &req); err != nil {
+				// already handled, acknowledge so that fal stops retrying
+				if errors.Is(err, ErrDuplicateDelivery) {
+					w.WriteHeader(http.StatusOK)
+					return
+				}
+				http.Error(w, err.Error(), verifyErrorStatus(err))
+				return
+			}
+			rec := &statusRecorder{ResponseWriter: w}
+			handled := false
+			defer func() {
+				// a panicking handler leaves the delivery to a redelivery
+				if handled && rec.status < http.StatusBadRequest {
+					v.finish(r)
+				} else {
+					v.Forget(context.WithoutCancel(r.Context()), r)
+				}
+			}()
+			next.ServeHTTP(rec, r.WithContext(context.WithValue(r.Context(), requestContextKey{}, &req)))
+			handled = true
+		})
+	}
+}
+
+// verifyErrorStatus maps verify errors to http status codes
+func verifyErrorStatus(err error) int {
+	switch {
+	case errors.Is(err, ErrInvalidSignature), errors.Is(err, ErrInvalidTimestamp):
+		return http.StatusUnauthorized
+	case errors.Is(err, ErrMissingHeader):
+		return http.StatusBadRequest
+	case errors.Is(err, ErrBodyTooLarge):
+		return http.StatusRequestEntityTooLarge
+	case errors.Is(err, ErrReplayedDelivery), errors.Is(err, ErrDuplicateDelivery):
+		return http.StatusConflict
+	case errors.Is(err, ErrDeliveryInProgress):
+		// fal retries the delivery later
+		return http.StatusServiceUnavailable
+	}
+	var syntaxErr *json.SyntaxError
+	var typeErr *json.UnmarshalTypeError
+	if errors.As(err, &syntaxErr) || errors.As(err, &typeErr) {
+		return http.StatusBadRequest
+	}
+	return http.StatusInternalServerError
+}
@@ -0,0 +1,114 @@
+package webhook
+
+import (
+	"context"
+	"crypto/ed25519"
+	"crypto/rand"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func TestHandler(t *testing.T) {
+	pub, priv, _ := ed25519.GenerateKey(rand.Reader)
+	srv := newJWKSServer(t, pub)
+	defer srv.Close()
+	verifier := NewVerifier(WithJWKSEndpoint(srv.URL), WithHTTPClient(srv.Client()))
+
+	type result struct {
+		Seed int64 `json:"seed"`
+	}
+	var (
+		seeds    []int64
+		errs     []string
+		fluxHits int
+		oneShot  int
+	)
+	h := NewHandler(
+		WithVerifier[result](verifier),
+		OnSuccess(func(ctx context.Context, req *Request, payload *result) error {
+			seeds = append(seeds, payload.Seed)
+			return nil
+		}),
+		OnError[result](func(ctx context.Context, req *Request) error {
+			errs = append(errs, req.Error())
+			return nil
+		}),
+		OnEndpointSuccess("fal-ai/flux", func(ctx context.Context, req *Request, payload *result) error {
+			fluxHits++
+			if payload.Seed < 0 {
+				return errors.New("unexpected seed")
+			}
+			return nil
+		}),
+	)
+	h.HandleRequest("req-once", func(ctx context.Context, req *Request, payload *result) error {
+		oneShot++
+		return nil
+	}, nil)
+
+	tests := []struct {
+		name   string
+		target string
+		req    *http.Request
+		code   int
+	}{
+		{name: "success", target: "/webhook", req: newSignedRequest(priv, "req-1", time.Now(), `{"request_id":"req-1","status":"OK","payload":{"seed":1}}`), code: http.StatusOK},
+		{name: "error", target: "/webhook", req: newSignedRequest(priv, "req-2", time.Now(), `{"request_id":"req-2","status":"ERROR","error":"boom"}`), code: http.StatusOK},
+		{name: "endpoint", target: "/webhook?endpoint=fal-ai/flux", req: newSignedRequest(priv, "req-3", time.Now(), `{"request_id":"req-3","status":"OK","payload":{"seed":3}}`), code: http.StatusOK},
+		{name: "callback failure", target: "/webhook?endpoint=fal-ai/flux", req: newSignedRequest(priv, "req-4", time.Now(), `{"request_id":"req-4","status":"OK","payload":{"seed":-1}}`), code: http.StatusInternalServerError},
+		{name: "invalid payload", target: "/webhook", req: newSignedRequest(priv, "req-5", time.Now(), `{"request_id":"req-5","status":"OK","payload":{"seed":"x"}}`), code: http.StatusBadRequest},
+		{name: "one shot", target: "/webhook?endpoint=fal-ai/flux", req: newSignedRequest(priv, "req-once", time.Now(), `{"request_id":"req-once","status":"OK","payload":{"seed":6}}`), code: http.StatusOK},
+		{name: "one shot removed", target: "/webhook", req: newSignedRequest(priv, "req-once", time.Now(), `{"request_id":"req-once","status":"OK","payload":{"seed":7}}`), code: http.StatusOK},
+		{name: "invalid signature", target: "/webhook", req: newSignedRequest(ed25519.NewKeyFromSeed(make([]byte, ed25519.SeedSize)), "req-8", time.Now(), `{}`), code: http.StatusUnauthorized},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			httpReq := httptest.NewRequest(http.MethodPost, tt.target, tt.req.Body)
+			httpReq.Header = tt.req.Header
+			w := httptest.NewRecorder()
+			h.ServeHTTP(w, httpReq)
+			if w.Code != tt.code {
+				t.Errorf("expect status %d, got %d: %s", tt.code, w.Code, w.Body.String())
+			}
+		})
+	}
+	if len(seeds) != 2 || seeds[0] != 1 || seeds[1] != 7 {
+		t.Errorf("unexpected seeds: %v", seeds)
+	}
+	if len(errs) != 1 || errs[0] != "boom" {
+		t.Errorf("unexpected errors: %v", errs)
+	}
+	if fluxHits != 2 {
+		t.Errorf("expect 2 endpoint hits, got %d", fluxHits)
+	}
+	if oneShot != 1 {
+		t.Errorf("expect 1 one shot hit, got %d", oneShot)
+	}
+}
+
+func TestMiddleware(t *testing.T) {
+	pub, priv, _ := ed25519.GenerateKey(rand.Reader)
+	srv := newJWKSServer(t, pub)
+	defer srv.Close()
+	verifier := NewVerifier(WithJWKSEndpoint(srv.URL), WithHTTPClient(srv.Client()))
+
+	var got *Request
+	h := Middleware(verifier)(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		got, _ = RequestFromContext(r.Context())
+	}))
+	w := httptest.NewRecorder()
+	h.ServeHTTP(w, newSignedRequest(priv, "req-1", time.Now(), `{"request_id":"req-1","status":"OK"}`))
+	if w.Code != http.StatusOK || got == nil || got.RequestID != "req-1" {
+		t.Errorf("unexpected result: %d %+v", w.Code, got)
+	}
+	w = httptest.NewRecorder()
+	req := newSignedRequest(priv, "req-1", time.Now(), `{}`)
+	req.Header.Del(HeaderSignature)
+	h.ServeHTTP(w, req)
+	if w.Code != http.StatusBadRequest {
+		t.Errorf("expect status %d, got %d", http.StatusBadRequest, w.Code)
+	}
+}
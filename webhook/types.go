@@ -16,6 +16,8 @@ type Request struct {
 	Err              string          `json:"error,omitempty"`
 	Payload          json.RawMessage `json:"payload,omitempty"`
 	PayloadError     string          `json:"payload_error,omitempty"`
+	// Duplicate the request was already delivered, set by the verifier with DuplicateFlag policy
+	Duplicate bool `json:"-"`
 }
 
 func (r Request) IsError() bool {
@@ -3,10 +3,12 @@ package webhook
 import (
 	"bytes"
 	"context"
+	"crypto/ed25519"
 	"crypto/sha256"
 	"encoding/hex"
 	"encoding/json"
 	"errors"
+	"fmt"
 	"io"
 	"net/http"
 	"strconv"
@@ -15,67 +17,298 @@ import (
 
 	"github.com/lestrrat-go/httprc/v3"
 	"github.com/lestrrat-go/jwx/v3/jwk"
-	"github.com/lestrrat-go/jwx/v3/jws"
 )
 
 var (
-	cache     *jwk.Cache
-	onceCache = new(sync.Once)
+	ErrMissingHeader    = errors.New("missing webhook header")
+	ErrInvalidTimestamp = errors.New("invalid timestamp")
+	ErrInvalidSignature = errors.New("invalid signature")
+	ErrBodyTooLarge     = errors.New("webhook body too large")
 )
 
+var defaultVerifier = NewVerifier()
+
+type VerifierOption func(*Verifier)
+
+// WithJWKSEndpoint overrides the jwks endpoint, default JWSKEndpoint
+func WithJWKSEndpoint(v string) VerifierOption {
+	return func(r *Verifier) {
+		r.jwksURL = v
+	}
+}
+
+// WithHTTPClient sets the http client used to fetch the jwks
+func WithHTTPClient(clt *http.Client) VerifierOption {
+	return func(r *Verifier) {
+		r.http = clt
+	}
+}
+
+// WithTolerance sets the max allowed difference between the webhook timestamp and now, default Tolerance
+func WithTolerance(d time.Duration) VerifierOption {
+	return func(r *Verifier) {
+		r.tolerance = d
+	}
+}
+
+// WithMaxBodySize sets the max size of a webhook request body, default DefaultMaxBodySize, <= 0 disables the limit.
+// The body is read before the signature is checked, larger bodies fail with ErrBodyTooLarge
+func WithMaxBodySize(n int64) VerifierOption {
+	return func(r *Verifier) {
+		r.maxBodySize = n
+	}
+}
+
+// WithDeliveryStore enables replay protection and duplicate delivery tracking
+func WithDeliveryStore(store DeliveryStore) VerifierOption {
+	return func(r *Verifier) {
+		r.deliveries = store
+	}
+}
+
+// WithDuplicatePolicy sets how duplicate deliveries are handled, default DuplicateReject
+func WithDuplicatePolicy(p DuplicatePolicy) VerifierOption {
+	return func(r *Verifier) {
+		r.duplicatePolicy = p
+	}
+}
+
+// WithDeliveryTTL sets how long a delivered request id is remembered, default DefaultDeliveryTTL
+func WithDeliveryTTL(d time.Duration) VerifierOption {
+	return func(r *Verifier) {
+		r.deliveryTTL = d
+	}
+}
+
+// Verifier verifies fal webhook requests
+type Verifier struct {
+	jwksURL         string
+	http            *http.Client
+	tolerance       time.Duration
+	maxBodySize     int64
+	deliveries      DeliveryStore
+	duplicatePolicy DuplicatePolicy
+	deliveryTTL     time.Duration
+	cache           *jwk.Cache
+	onceCache       *sync.Once
+	// inflight request ids of the deliveries being handled by Handler or Middleware
+	inflight     map[string]struct{}
+	inflightLock sync.Mutex
+	// ctx lifetime of the jwk cache refreshing the jwks in the background, canceled by Close
+	ctx    context.Context
+	cancel context.CancelFunc
+	lock   sync.Mutex
+}
+
+func NewVerifier(opts ...VerifierOption) *Verifier {
+	ret := &Verifier{
+		jwksURL:     JWSKEndpoint,
+		tolerance:   Tolerance,
+		maxBodySize: DefaultMaxBodySize,
+		deliveryTTL: DefaultDeliveryTTL,
+		onceCache:   new(sync.Once),
+		inflight:    make(map[string]struct{}),
+	}
+	for _, opt := range opts {
+		opt(ret)
+	}
+	if ret.http == nil {
+		ret.http = http.DefaultClient
+	}
+	ret.ctx, ret.cancel = context.WithCancel(context.Background())
+	return ret
+}
+
+// Close stops the background refresh of the jwks, Verify fails once the verifier is closed
+func (r *Verifier) Close() error {
+	r.cancel()
+	return nil
+}
+
+// JWKCache returns the jwk cache of the default verifier
 func JWKCache(ctx context.Context) (*jwk.Cache, error) {
+	return defaultVerifier.JWKCache(ctx)
+}
+
+// JWKCache returns the jwk cache with the jwks endpoint registered.
+// The cache lives until Close, ctx only bounds the registration of the jwks endpoint
+func (r *Verifier) JWKCache(ctx context.Context) (*jwk.Cache, error) {
+	r.lock.Lock()
+	defer r.lock.Unlock()
 	var retErr error
-	onceCache.Do(func() {
-		if c, err := jwk.NewCache(ctx, httprc.NewClient()); err != nil {
-			onceCache = new(sync.Once)
+	r.onceCache.Do(func() {
+		if c, err := jwk.NewCache(r.ctx, httprc.NewClient()); err != nil {
+			r.onceCache = new(sync.Once)
 			retErr = err
-		} else if err := c.Register(ctx, JWSKEndpoint, jwk.WithConstantInterval(time.Hour*24)); err != nil {
-			onceCache = new(sync.Once)
+		} else if err := c.Register(ctx, r.jwksURL, jwk.WithConstantInterval(time.Hour*24), jwk.WithHTTPClient(r.http)); err != nil {
+			r.onceCache = new(sync.Once)
 			retErr = err
 		} else {
-			cache = c
+			r.cache = c
 		}
 	})
-	return cache, retErr
+	return r.cache, retErr
 }
 
+// Verify verifies the webhook request with the default verifier and decodes it into req
 func Verify(ctx context.Context, httpReq *http.Request, req *Request) error {
-	cache, err := JWKCache(ctx)
+	return defaultVerifier.Verify(ctx, httpReq, req)
+}
+
+// Verify verifies the ED25519 signature of the webhook request against the jwks and decodes it into req.
+// The request body is restored so it can be read again by downstream handlers
+func (r *Verifier) Verify(ctx context.Context, httpReq *http.Request, req *Request) error {
+	return r.verify(ctx, httpReq, req, false)
+}
+
+// begin verifies the webhook request and marks the delivery in progress until finish or Forget is called,
+// a concurrent delivery of the same request fails with ErrDeliveryInProgress
+func (r *Verifier) begin(ctx context.Context, httpReq *http.Request, req *Request) error {
+	return r.verify(ctx, httpReq, req, true)
+}
+
+// finish clears the in progress mark of a delivery handled successfully, the delivery stays recorded
+func (r *Verifier) finish(httpReq *http.Request) {
+	r.inflightLock.Lock()
+	defer r.inflightLock.Unlock()
+	delete(r.inflight, httpReq.Header.Get(HeaderRequestID))
+}
+
+func (r *Verifier) verify(ctx context.Context, httpReq *http.Request, req *Request, hold bool) error {
+	header := httpReq.Header
+	requestID := header.Get(HeaderRequestID)
+	userID := header.Get(HeaderUserID)
+	timestamp := header.Get(HeaderTimestamp)
+	signature := header.Get(HeaderSignature)
+	for _, k := range []string{HeaderRequestID, HeaderUserID, HeaderTimestamp, HeaderSignature} {
+		if header.Get(k) == "" {
+			return fmt.Errorf("%w: %s", ErrMissingHeader, k)
+		}
+	}
+	ts, err := strconv.ParseInt(timestamp, 10, 64)
 	if err != nil {
-		return err
+		return fmt.Errorf("%w: %s", ErrInvalidTimestamp, timestamp)
+	}
+	if time.Since(time.Unix(ts, 0)).Abs() > r.tolerance {
+		return fmt.Errorf("%w: %s", ErrInvalidTimestamp, timestamp)
 	}
-	jwkSet, err := cache.Lookup(ctx, JWSKEndpoint)
+	sig, err := hex.DecodeString(signature)
 	if err != nil {
+		return errors.Join(ErrInvalidSignature, err)
+	}
+	reader := httpReq.Body
+	if r.maxBodySize > 0 {
+		reader = http.MaxBytesReader(nil, httpReq.Body, r.maxBodySize)
+	}
+	body, err := io.ReadAll(reader)
+	if err != nil {
+		var maxErr *http.MaxBytesError
+		if errors.As(err, &maxErr) {
+			return fmt.Errorf("%w: over %d bytes", ErrBodyTooLarge, maxErr.Limit)
+		}
 		return err
 	}
-	header := httpReq.Header
-	timestamp := header.Get("X-Fal-Webhook-Timestamp")
-	ts, _ := strconv.ParseInt(timestamp, 10, 64)
-	if time.Since(time.Unix(ts, 0)).Abs().Seconds() > 300 {
-		return errors.New("invalid timestamp")
+	httpReq.Body.Close()
+	httpReq.Body = io.NopCloser(bytes.NewReader(body))
+	cache, err := r.JWKCache(ctx)
+	if err != nil {
+		return err
 	}
-	signature := header.Get("X-Fal-Webhook-Signature")
-	sig, err := hex.DecodeString(signature)
+	jwkSet, err := cache.Lookup(ctx, r.jwksURL)
 	if err != nil {
 		return err
 	}
-	requestID := header.Get("X-Fal-Webhook-Request-Id")
-	userID := header.Get("X-Fal-Webhook-User-Id")
-	var verifyBuf bytes.Buffer
-	verifyBuf.WriteString(requestID)
-	verifyBuf.WriteByte('\n')
-	verifyBuf.WriteString(userID)
-	verifyBuf.WriteByte('\n')
-	verifyBuf.WriteString(timestamp)
-	verifyBuf.WriteByte('\n')
-	var reqBuf bytes.Buffer
-	tee := io.TeeReader(httpReq.Body, &reqBuf)
-	h := sha256.New()
-	io.Copy(h, tee)
-	hashBody := hex.EncodeToString(h.Sum(nil))
-	verifyBuf.WriteString(hashBody)
-	if _, err := jws.Verify(sig, jws.WithKeySet(jwkSet)); err != nil {
+	if !verifySignature(jwkSet, SignedMessage(requestID, userID, timestamp, body), sig) {
+		return ErrInvalidSignature
+	}
+	if err := json.Unmarshal(body, req); err != nil {
+		return err
+	}
+	return r.track(ctx, requestID, signature, req, hold)
+}
+
+// track records the delivery in the delivery store, hold marks it in progress
+func (r *Verifier) track(ctx context.Context, requestID string, signature string, req *Request, hold bool) error {
+	if r.deliveries == nil {
+		return nil
+	}
+	// a replayed signature is only accepted within the timestamp tolerance window
+	if seen, err := r.deliveries.Add(ctx, signatureKey(signature), 2*r.tolerance); err != nil {
 		return err
+	} else if seen {
+		return fmt.Errorf("%w: %s", ErrReplayedDelivery, requestID)
+	}
+	// the mark is checked and set with the record so that a concurrent redelivery sees either
+	r.inflightLock.Lock()
+	defer r.inflightLock.Unlock()
+	if _, ok := r.inflight[requestID]; ok {
+		return fmt.Errorf("%w: %s", ErrDeliveryInProgress, requestID)
+	}
+	seen, err := r.deliveries.Add(ctx, requestKey(requestID), r.deliveryTTL)
+	if err != nil {
+		return err
+	}
+	if !seen {
+		if hold {
+			r.inflight[requestID] = struct{}{}
+		}
+		return nil
+	}
+	if r.duplicatePolicy == DuplicateFlag {
+		req.Duplicate = true
+		return nil
+	}
+	return fmt.Errorf("%w: %s", ErrDuplicateDelivery, requestID)
+}
+
+// Forget removes the delivery from the delivery store so that a redelivery is accepted,
+// call it when the delivery could not be processed
+func (r *Verifier) Forget(ctx context.Context, httpReq *http.Request) error {
+	if r.deliveries == nil {
+		return nil
+	}
+	header := httpReq.Header
+	r.inflightLock.Lock()
+	delete(r.inflight, header.Get(HeaderRequestID))
+	r.inflightLock.Unlock()
+	return errors.Join(
+		r.deliveries.Remove(ctx, signatureKey(header.Get(HeaderSignature))),
+		r.deliveries.Remove(ctx, requestKey(header.Get(HeaderRequestID))),
+	)
+}
+
+// SignedMessage builds the message signed by fal:
+// request id, user id, timestamp and the hex encoded sha256 of the body joined by newlines
+func SignedMessage(requestID string, userID string, timestamp string, body []byte) []byte {
+	hash := sha256.Sum256(body)
+	var buf bytes.Buffer
+	buf.WriteString(requestID)
+	buf.WriteByte('\n')
+	buf.WriteString(userID)
+	buf.WriteByte('\n')
+	buf.WriteString(timestamp)
+	buf.WriteByte('\n')
+	buf.WriteString(hex.EncodeToString(hash[:]))
+	return buf.Bytes()
+}
+
+// verifySignature reports whether the signature matches any ED25519 key of the set
+func verifySignature(set jwk.Set, msg []byte, sig []byte) bool {
+	if len(sig) != ed25519.SignatureSize {
+		return false
+	}
+	for i := range set.Len() {
+		key, ok := set.Key(i)
+		if !ok {
+			continue
+		}
+		var pub ed25519.PublicKey
+		if err := jwk.Export(key, &pub); err != nil {
+			continue
+		}
+		if ed25519.Verify(pub, msg, sig) {
+			return true
+		}
 	}
-	return json.NewDecoder(&reqBuf).Decode(req)
+	return false
 }
@@ -0,0 +1,184 @@
+package webhook
+
+import (
+	"context"
+	"crypto/ed25519"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/lestrrat-go/jwx/v3/jwk"
+)
+
+// newJWKSServer serves a jwks containing the public keys
+func newJWKSServer(t *testing.T, keys ...ed25519.PublicKey) *httptest.Server {
+	t.Helper()
+	set := jwk.NewSet()
+	for _, pub := range keys {
+		key, err := jwk.Import(pub)
+		if err != nil {
+			t.Fatal(err)
+		}
+		set.AddKey(key)
+	}
+	bs, err := json.Marshal(set)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		w.Write(bs)
+	}))
+}
+
+// newSignedRequest builds a webhook request signed by the private key
+func newSignedRequest(priv ed25519.PrivateKey, requestID string, ts time.Time, body string) *http.Request {
+	timestamp := strconv.FormatInt(ts.Unix(), 10)
+	sig := ed25519.Sign(priv, SignedMessage(requestID, "user-1", timestamp, []byte(body)))
+	req := httptest.NewRequest(http.MethodPost, "/webhook", strings.NewReader(body))
+	req.Header.Set(HeaderRequestID, requestID)
+	req.Header.Set(HeaderUserID, "user-1")
+	req.Header.Set(HeaderTimestamp, timestamp)
+	req.Header.Set(HeaderSignature, hex.EncodeToString(sig))
+	return req
+}
+
+func TestVerify(t *testing.T) {
+	_, rotated, _ := ed25519.GenerateKey(rand.Reader)
+	pub, priv, _ := ed25519.GenerateKey(rand.Reader)
+	_, other, _ := ed25519.GenerateKey(rand.Reader)
+	srv := newJWKSServer(t, rotated.Public().(ed25519.PublicKey), pub)
+	defer srv.Close()
+	verifier := NewVerifier(WithJWKSEndpoint(srv.URL), WithHTTPClient(srv.Client()))
+
+	const body = `{"request_id":"req-1","status":"OK","payload":{"seed":1}}`
+	tests := []struct {
+		name   string
+		req    func() *http.Request
+		target error
+	}{
+		{
+			name: "valid",
+			req:  func() *http.Request { return newSignedRequest(priv, "req-1", time.Now(), body) },
+		},
+		{
+			name:   "unknown key",
+			req:    func() *http.Request { return newSignedRequest(other, "req-1", time.Now(), body) },
+			target: ErrInvalidSignature,
+		},
+		{
+			name: "tampered body",
+			req: func() *http.Request {
+				req := newSignedRequest(priv, "req-1", time.Now(), body)
+				req.Body = io.NopCloser(strings.NewReader(strings.Replace(body, "OK", "ERROR", 1)))
+				return req
+			},
+			target: ErrInvalidSignature,
+		},
+		{
+			name: "tampered request id",
+			req: func() *http.Request {
+				req := newSignedRequest(priv, "req-1", time.Now(), body)
+				req.Header.Set(HeaderRequestID, "req-2")
+				return req
+			},
+			target: ErrInvalidSignature,
+		},
+		{
+			name:   "stale timestamp",
+			req:    func() *http.Request { return newSignedRequest(priv, "req-1", time.Now().Add(-time.Hour), body) },
+			target: ErrInvalidTimestamp,
+		},
+		{
+			name: "malformed signature",
+			req: func() *http.Request {
+				req := newSignedRequest(priv, "req-1", time.Now(), body)
+				req.Header.Set(HeaderSignature, "not-hex")
+				return req
+			},
+			target: ErrInvalidSignature,
+		},
+		{
+			name: "missing header",
+			req: func() *http.Request {
+				req := newSignedRequest(priv, "req-1", time.Now(), body)
+				req.Header.Del(HeaderUserID)
+				return req
+			},
+			target: ErrMissingHeader,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			httpReq := tt.req()
+			var req Request
+			err := verifier.Verify(context.Background(), httpReq, &req)
+			if tt.target != nil {
+				if !errors.Is(err, tt.target) {
+					t.Fatalf("expect %v, got %v", tt.target, err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if req.RequestID != "req-1" || req.Status != OK {
+				t.Errorf("unexpected request: %+v", req)
+			}
+			restored, _ := io.ReadAll(httpReq.Body)
+			if string(restored) != body {
+				t.Errorf("body not restored, got %s", restored)
+			}
+		})
+	}
+}
+
+func TestVerifyAfterFirstContextCancelled(t *testing.T) {
+	pub, priv, _ := ed25519.GenerateKey(rand.Reader)
+	srv := newJWKSServer(t, pub)
+	defer srv.Close()
+	verifier := NewVerifier(WithJWKSEndpoint(srv.URL), WithHTTPClient(srv.Client()))
+	defer verifier.Close()
+
+	const body = `{"request_id":"req-1","status":"OK"}`
+	// the jwk cache outlives the request which created it
+	ctx, cancel := context.WithCancel(context.Background())
+	if err := verifier.Verify(ctx, newSignedRequest(priv, "req-1", time.Now(), body), new(Request)); err != nil {
+		t.Fatal(err)
+	}
+	cancel()
+	for range 3 {
+		ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+		err := verifier.Verify(ctx, newSignedRequest(priv, "req-1", time.Now(), body), new(Request))
+		cancel()
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+func TestVerifyBodyTooLarge(t *testing.T) {
+	pub, priv, _ := ed25519.GenerateKey(rand.Reader)
+	srv := newJWKSServer(t, pub)
+	defer srv.Close()
+	verifier := NewVerifier(WithJWKSEndpoint(srv.URL), WithHTTPClient(srv.Client()), WithMaxBodySize(64))
+	defer verifier.Close()
+
+	body := `{"request_id":"req-1","status":"OK","payload":{"prompt":"` + strings.Repeat("a", 64) + `"}}`
+	if err := verifier.Verify(context.Background(), newSignedRequest(priv, "req-1", time.Now(), body), new(Request)); !errors.Is(err, ErrBodyTooLarge) {
+		t.Fatalf("expect body too large, got %v", err)
+	}
+	rec := httptest.NewRecorder()
+	Middleware(verifier)(http.NotFoundHandler()).ServeHTTP(rec, newSignedRequest(priv, "req-1", time.Now(), body))
+	if rec.Code != http.StatusRequestEntityTooLarge {
+		t.Errorf("expect status %d, got %d", http.StatusRequestEntityTooLarge, rec.Code)
+	}
+}